@@ -10,3 +10,29 @@ type Backend interface {
 	WriteState(*DirState)
 	Close()
 }
+
+// Implemented by backends that buffer writes until Close, so that long
+// operations can commit their progress and be resumed after a crash.
+type Checkpointer interface {
+	Checkpoint()
+}
+
+// Implemented by backends that can tell whether they hold a block
+// without reading it, like remote ones.
+type BlockChecker interface {
+	HasBlock(*StrongHash) bool
+}
+
+// Tells whether the backend holds the block
+func hasBlock(backend Backend, strong *StrongHash) bool {
+	if bc, ok := backend.(BlockChecker); ok {
+		return bc.HasBlock(strong)
+	}
+	return backend.ReadStrong(strong) != nil
+}
+
+// Implemented by backends that can hand out a bloom filter of their
+// weak hashes, so that remote clients can search them locally.
+type WeakFilterer interface {
+	WeakFilter() []byte
+}
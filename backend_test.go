@@ -1,8 +1,13 @@
 package enki
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
 )
 
 func ExampleIntToBytes() {
@@ -18,3 +23,165 @@ func ExampleIntToBytes() {
 	// [0 0 0 0 85 102 235 250]
 	// [0 0 0 0 85 102 236 6]
 }
+
+func TestBoltRecovery(t *testing.T) {
+	dotDir := t.TempDir()
+	first := Block("first block")
+	second := Block("second block")
+	blobPath := path.Join(dotDir, "packs", "blocks-00000001.pack")
+
+	backend := NewBoltBackend(dotDir)
+	weak, _, _ := GetWeakHash(first)
+	backend.AddBlock(weak, GetStrongHash(first), first)
+	backend.Close()
+	info, err := os.Stat(blobPath)
+	check(err)
+	committed := info.Size()
+
+	// Bytes written by a crashed process are discarded on open
+	fd, err := os.OpenFile(blobPath, os.O_APPEND|os.O_WRONLY, 0)
+	check(err)
+	_, err = fd.Write([]byte("half-written record"))
+	check(err)
+	check(fd.Close())
+	backend = NewBoltBackend(dotDir)
+	info, err = os.Stat(blobPath)
+	check(err)
+	if info.Size() != committed {
+		t.Errorf("Uncommitted data not truncated")
+	}
+	weak, _, _ = GetWeakHash(second)
+	backend.AddBlock(weak, GetStrongHash(second), second)
+	backend.Close()
+
+	// Lost data is detected and its index entry removed
+	check(os.Truncate(blobPath, committed+2))
+	backend = NewBoltBackend(dotDir)
+	defer backend.Close()
+	if !bytes.Equal(backend.ReadStrong(GetStrongHash(first)), first) {
+		t.Errorf("Committed block lost")
+	}
+	if backend.ReadStrong(GetStrongHash(second)) != nil {
+		t.Errorf("Dangling entry not removed")
+	}
+}
+
+func TestPackStore(t *testing.T) {
+	defer func(size int64) { packSize = size }(packSize)
+	packSize = 1024
+	dotDir := t.TempDir()
+	var blocks []Block
+	for i := 0; i < 20; i++ {
+		block := make(Block, 300)
+		rand.Read(block)
+		blocks = append(blocks, block)
+	}
+	add := func(backend Backend, blocks []Block) {
+		for _, block := range blocks {
+			weak, _, _ := GetWeakHash(block)
+			backend.AddBlock(weak, GetStrongHash(block), block)
+		}
+	}
+
+	backend := NewBoltBackend(dotDir)
+	add(backend, blocks[:10])
+	backend.Close()
+	sealed, err := ReadPackIndex(path.Join(dotDir, "packs", "blocks-00000001.pack"))
+	check(err)
+	if len(sealed) == 0 || len(sealed) >= 10 {
+		t.Errorf("Unexpected pack index size: %v", len(sealed))
+	}
+	for i, entry := range sealed {
+		weak, _, _ := GetWeakHash(blocks[i])
+		if !bytes.Equal(entry.Key, GetStrongHash(blocks[i])[:]) || entry.Weak != weak {
+			t.Errorf("Unexpected index entry %v", i)
+		}
+	}
+
+	// A seal that is not committed is undone on next open
+	backend = NewBoltBackend(dotDir)
+	add(backend, blocks[10:])
+	backend.(*BoltBackend).Abort()
+	backend = NewBoltBackend(dotDir)
+	for i, block := range blocks {
+		found := backend.ReadStrong(GetStrongHash(block)) != nil
+		if found != (i < 10) {
+			t.Errorf("Block %v: unexpected presence %v", i, found)
+		}
+	}
+	add(backend, blocks[10:])
+	backend.Close()
+
+	backend = NewReadOnlyBoltBackend(dotDir)
+	defer backend.Close()
+	for i, block := range blocks {
+		if !bytes.Equal(backend.ReadStrong(GetStrongHash(block)), block) {
+			t.Errorf("Block %v not found", i)
+		}
+	}
+}
+
+func TestBoltReadOnly(t *testing.T) {
+	dotDir := t.TempDir()
+	block := Block("some block")
+	weak, _, _ := GetWeakHash(block)
+	backend := NewBoltBackend(dotDir)
+	backend.AddBlock(weak, GetStrongHash(block), block)
+	backend.WriteState(&DirState{Timestamp: 1432808440})
+	backend.Close()
+	info, err := os.Stat(path.Join(dotDir, "indexes.bolt"))
+	check(err)
+
+	// Several readers can open the repository at once
+	first := NewReadOnlyBoltBackend(dotDir)
+	second := NewReadOnlyBoltBackend(dotDir)
+	for _, reader := range []Backend{first, second} {
+		if !reader.SearchWeak(weak) {
+			t.Errorf("Weak hash not found")
+		}
+		if !bytes.Equal(reader.ReadStrong(GetStrongHash(block)), block) {
+			t.Errorf("Block not found")
+		}
+		if LastState(reader).Timestamp != 1432808440 {
+			t.Errorf("State not found")
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Write on read-only backend should fail")
+			}
+		}()
+		first.AddBlock(weak, GetStrongHash(block), block)
+	}()
+	first.Close()
+	second.Close()
+
+	after, err := os.Stat(path.Join(dotDir, "indexes.bolt"))
+	check(err)
+	if !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("Read-only backend modified the repository")
+	}
+}
+
+func TestBloomSettings(t *testing.T) {
+	dotDir := t.TempDir()
+	backend := NewBoltBackend(dotDir).(*BoltBackend)
+	backend.RebuildBloom(1000, 0.01)
+	backend.Close()
+
+	// A deleted filter is created again with the configured sizing
+	check(os.Remove(path.Join(dotDir, "weakmap.bloom")))
+	backend = NewBoltBackend(dotDir).(*BoltBackend)
+	m, k := BloomSize(1000, 0.01)
+	if backend.bloom.m != m || backend.bloom.k != k || backend.bloom.Capacity() != 1000 {
+		t.Errorf("Unexpected bloom filter size: %v %v", backend.bloom.m, backend.bloom.k)
+	}
+	// The rate is kept when only the capacity is given
+	backend.RebuildBloom(2000, 0)
+	m, k = BloomSize(2000, 0.01)
+	if backend.bloom.m != m || backend.bloom.k != k {
+		t.Errorf("Unexpected bloom filter size: %v %v", backend.bloom.m, backend.bloom.k)
+	}
+	backend.Close()
+}
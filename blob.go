@@ -3,6 +3,7 @@ package enki
 import (
 	"bytes"
 	"crypto/md5"
+	"fmt"
 	"io"
 )
 
@@ -18,26 +19,75 @@ type Blob struct {
 	backend Backend
 }
 
+func NewBlob(backend Backend) *Blob {
+	return &Blob{backend}
+}
+
 func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature, err error) {
-	var aweak, bweak, weak, oldWeak WeakHash
+	sgn = NewSignature(self.backend)
+	matchBlocks(fd, blocksize, &signatureMatcher{backend: self.backend, sgn: sgn})
+	sgn.Close()
+	return sgn, nil
+}
+
+// Receives the outcome of matchBlocks
+type blockMatcher interface {
+	// Returns true if a known block may have this weak hash
+	searchWeak(weak WeakHash) bool
+	// Returns true if the block is known, it is then passed to
+	// reference
+	searchStrong(block Block) bool
+	// Data that did not match any known block
+	literal(data []byte)
+	reference(weak WeakHash, block Block)
+}
+
+// Stores the content in the backend, known blocks are referenced
+// and the new ones added
+type signatureMatcher struct {
+	backend Backend
+	sgn     *Signature
+	strong  *StrongHash
+}
+
+func (self *signatureMatcher) searchWeak(weak WeakHash) bool {
+	return self.backend.SearchWeak(weak)
+}
+
+func (self *signatureMatcher) searchStrong(block Block) bool {
+	self.strong = GetStrongHash(block)
+	return hasBlock(self.backend, self.strong)
+}
+
+func (self *signatureMatcher) literal(data []byte) {
+	self.sgn.AddData(data)
+}
+
+func (self *signatureMatcher) reference(weak WeakHash, block Block) {
+	self.sgn.AddHash(weak, self.strong, int64(len(block)))
+}
+
+// Rolls a window of blocksize bytes over fd, and splits the content
+// between literal data and references to the blocks known by the
+// matcher.
+func matchBlocks(fd io.Reader, blocksize int64, matcher blockMatcher) {
+	var aweak, bweak, weak WeakHash
 	var readSize, partialReadSize, blockOffset, lastMatch int64
 	var isRolling, matchFound, eofReached bool
 	var data []byte
 	oldBlock := Block{}
 	newBlock := Block{}
 	fullBlock := Block(make([]byte, blocksize))
-	sgn = &Signature{}
-
 	// Read first block
 	data = make([]byte, blocksize)
 	prs, err := io.ReadFull(fd, data)
 	partialReadSize = int64(prs)
 	if err != nil {
 		if err == io.ErrUnexpectedEOF {
-			sgn.AddData(data[:partialReadSize])
-			return sgn, nil
+			matcher.literal(data[:partialReadSize])
+			return
 		} else if err == io.EOF {
-			return sgn, nil
+			return
 		} else {
 			panic(err)
 		}
@@ -51,15 +101,12 @@ func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature,
 	partialReadSize = int64(prs)
 	if err != nil {
 		if err == io.ErrUnexpectedEOF {
-			strong := GetStrongHash(oldBlock)
-			weak, _, _ = GetWeakHash(oldBlock)
-			self.backend.AddBlock(weak, strong, oldBlock)
-			sgn.AddHash(oldWeak, strong)
-			sgn.AddData(data[:partialReadSize])
-			return sgn, nil
+			matcher.literal(oldBlock)
+			matcher.literal(data[:partialReadSize])
+			return
 		} else if err == io.EOF {
-			sgn.AddData(oldBlock)
-			return sgn, nil
+			matcher.literal(oldBlock)
+			return
 		} else {
 			panic(err)
 		}
@@ -78,12 +125,9 @@ func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature,
 			} else {
 				// Store old block
 				if lastMatch > 0 {
-					sgn.AddData(oldBlock[lastMatch:])
+					matcher.literal(oldBlock[lastMatch:])
 				} else {
-					strong := GetStrongHash(oldBlock)
-					oldWeak, _, _ = GetWeakHash(oldBlock)
-					self.backend.AddBlock(oldWeak, strong, oldBlock)
-					sgn.AddHash(oldWeak, strong)
+					matcher.literal(oldBlock)
 				}
 				blockOffset = 0
 				lastMatch = 0
@@ -91,8 +135,8 @@ func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature,
 
 			// Last read was too short
 			if partialReadSize < blocksize {
-				sgn.AddData(newBlock[blockOffset:partialReadSize])
-				return sgn, nil
+				matcher.literal(newBlock[blockOffset:partialReadSize])
+				return
 			}
 
 			// Read data
@@ -110,15 +154,12 @@ func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature,
 		}
 		if eofReached && blockOffset >= partialReadSize {
 			if lastMatch > 0 {
-				sgn.AddData(oldBlock[lastMatch:])
+				matcher.literal(oldBlock[lastMatch:])
 			} else {
-				strong := GetStrongHash(oldBlock)
-				oldWeak, _, _ = GetWeakHash(oldBlock)
-				self.backend.AddBlock(oldWeak, strong, oldBlock)
-				sgn.AddHash(oldWeak, strong)
+				matcher.literal(oldBlock)
 			}
-			sgn.AddData(newBlock[:partialReadSize])
-			return sgn, nil
+			matcher.literal(newBlock[:partialReadSize])
+			return
 		}
 
 		if !isRolling {
@@ -137,28 +178,30 @@ func (self *Blob) BuildSignature(fd io.Reader, blocksize int64) (sgn *Signature,
 			blockOffset += 1
 		}
 
-		if self.backend.SearchWeak(weak) {
+		if matcher.searchWeak(weak) {
 			fullBlock = concat(
 				oldBlock[blockOffset:],
 				newBlock[:blockOffset],
 			)
-			strong := GetStrongHash(fullBlock[:])
-			if self.backend.ReadStrong(strong) != nil {
+			if matcher.searchStrong(fullBlock) {
 				matchFound = true
-				sgn.AddHash(weak, strong)
+				// Keep the unmatched bytes preceding the match
+				if blockOffset > lastMatch {
+					matcher.literal(oldBlock[lastMatch:blockOffset])
+				}
+				matcher.reference(weak, fullBlock)
 			}
 		}
 	}
-
 }
 
-func (self *Blob) Restore(checksum []byte, w io.Writer) (nb_bytes int) {
+func (self *Blob) Restore(checksum []byte, w io.Writer) error {
 	sgn := self.backend.ReadSignature(checksum)
 	if sgn == nil {
-		return 0
+		return fmt.Errorf("Signature %x not found in backend", checksum)
 	}
 	sgn.Extract(self.backend, w)
-	return 0 // USEFULL ?
+	return nil
 }
 
 func (self *Blob) Snapshot(fd io.Reader, size int64) *Signature {
@@ -2,6 +2,7 @@ package enki
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -180,6 +181,84 @@ func checkSignature(backend Backend, blob *Blob) {
 	}
 }
 
+func TestLiteralBlocks(t *testing.T) {
+	data := make([]byte, 10000)
+	_, err := rand.Read(data)
+	check(err)
+	sgn := memoryBlob.Snapshot(bytes.NewReader(data), int64(len(data)))
+	if len(sgn.Segments) != 2 {
+		t.Errorf("Unexpected number of segments: %v", len(sgn.Segments))
+	}
+	for _, segment := range sgn.Segments {
+		if segment.Mode != HASH_SGM || segment.Data != nil {
+			t.Errorf("Literal data kept in signature")
+		}
+	}
+	tail := GetStrongHash(data[8*1024:])
+	if !bytes.Equal(memoryBackend.ReadStrong(tail), data[8*1024:]) {
+		t.Errorf("Literal block not found in backend")
+	}
+
+	var buf bytes.Buffer
+	sgn.Extract(memoryBackend, &buf)
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Extracted data mismatch")
+	}
+}
+
+func TestShiftedMatch(t *testing.T) {
+	// Store some content, then snapshot it again behind a few
+	// unmatched bytes so that the match starts inside a block
+	base := make([]byte, 3*8*1024)
+	_, err := rand.Read(base)
+	check(err)
+	boltBlob.Snapshot(bytes.NewReader(base), int64(len(base)))
+
+	head := make([]byte, 1000)
+	tail := make([]byte, 500)
+	_, err = rand.Read(head)
+	check(err)
+	_, err = rand.Read(tail)
+	check(err)
+	data := concat(head, base, tail)
+	sgn := boltBlob.Snapshot(bytes.NewReader(data), int64(len(data)))
+
+	var buf bytes.Buffer
+	sgn.Extract(boltBackend, &buf)
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Extracted data mismatch")
+	}
+}
+
+func TestSignatureTree(t *testing.T) {
+	// Use tiny chunks to get a tree with several levels
+	defer func(segments int) { chunkSegments = segments }(chunkSegments)
+	chunkSegments = 4
+
+	name := path.Join(test_data, "big-shifted.data")
+	fd, err := os.Open(name)
+	check(err)
+	defer fd.Close()
+	sgn := memoryBlob.Snapshot(fd, 0)
+	if len(sgn.Segments) > chunkSegments {
+		t.Errorf("Root has too many segments: %v", len(sgn.Segments))
+	}
+	for _, segment := range sgn.Segments {
+		if segment.Mode != INDEX_SGM {
+			t.Errorf("Unexpected segment mode in root: %v", segment.Mode)
+		}
+	}
+
+	var buf bytes.Buffer
+	sgn.Extract(memoryBackend, &buf)
+	expected, err := GetChecksum(name)
+	check(err)
+	checksum := md5.Sum(buf.Bytes())
+	if !bytes.Equal(expected, checksum[:]) {
+		t.Errorf("Wrong checksum!")
+	}
+}
+
 func TestMemorySignature(t *testing.T) {
 	checkSignature(memoryBackend, memoryBlob)
 }
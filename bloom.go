@@ -0,0 +1,229 @@
+package enki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	bloomHeaderSize = 32
+	// Default sizing, see calculate_bloom.py
+	DefaultBloomCapacity = 1 << 23
+	DefaultBloomFPRate   = 0.001
+	// 64 bits FNV-1a parameters
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+var bloomMagic = []byte("NKBF")
+
+// BloomFilter is a persistent bloom filter of weak hashes. The file is
+// memory-mapped, so every insertion is written in place and nothing
+// has to be loaded or saved in full.
+//
+// File layout (little endian): magic (4 bytes), number of hash
+// functions (4 bytes), number of bits (8 bytes), capacity (8 bytes),
+// number of entries (8 bytes), followed by the bit array.
+type BloomFilter struct {
+	file     *os.File
+	data     []byte
+	bits     []byte
+	k        uint32
+	m        uint64
+	writable bool
+}
+
+// Returns the number of bits and of hash functions needed to store n
+// entries with a false positive probability of p.
+func BloomSize(n uint64, p float64) (uint64, uint32) {
+	if n == 0 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(math.Ln2 * m / float64(n))
+	if k < 1 {
+		k = 1
+	}
+	// Round up to a full byte
+	bits := (uint64(m) + 7) / 8 * 8
+	return bits, uint32(k)
+}
+
+// Open the bloom filter at filePath, it is created with the given
+// capacity and false positive rate if it does not exist.
+func OpenBloomFilter(filePath string, capacity uint64, fpRate float64) (*BloomFilter, error) {
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return CreateBloomFilter(filePath, capacity, fpRate)
+	} else if err != nil {
+		return nil, err
+	}
+	return openBloomFilter(filePath, true)
+}
+
+// Create (or truncate) the bloom filter at filePath
+func CreateBloomFilter(filePath string, capacity uint64, fpRate float64) (*BloomFilter, error) {
+	header, m := bloomHeader(capacity, fpRate)
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(header)
+	if err == nil {
+		// Bits are zeroed (and the file sparse) on truncate
+		err = file.Truncate(bloomHeaderSize + int64(m/8))
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return openBloomFilter(filePath, true)
+}
+
+// Returns an empty in-memory bloom filter
+func NewBloomFilter(capacity uint64, fpRate float64) *BloomFilter {
+	header, m := bloomHeader(capacity, fpRate)
+	data := make([]byte, bloomHeaderSize+int64(m/8))
+	copy(data, header)
+	filter, err := LoadBloomFilter(data)
+	check(err)
+	return filter
+}
+
+// Returns the header of an empty filter and its number of bits
+func bloomHeader(capacity uint64, fpRate float64) ([]byte, uint64) {
+	m, k := BloomSize(capacity, fpRate)
+	header := make([]byte, bloomHeaderSize)
+	copy(header, bloomMagic)
+	binary.LittleEndian.PutUint32(header[4:], k)
+	binary.LittleEndian.PutUint64(header[8:], m)
+	binary.LittleEndian.PutUint64(header[16:], capacity)
+	return header, m
+}
+
+func openBloomFilter(filePath string, writable bool) (*BloomFilter, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(filePath, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	data, err := mapFile(file, int(info.Size()), writable)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	filter := &BloomFilter{file: file, data: data, writable: writable}
+	err = filter.parseHeader()
+	if err != nil {
+		filter.Close()
+		return nil, fmt.Errorf("%v in '%v'", err, filePath)
+	}
+	return filter, nil
+}
+
+// Returns an in-memory bloom filter from the content of a filter
+// file (as given by Bytes)
+func LoadBloomFilter(data []byte) (*BloomFilter, error) {
+	filter := &BloomFilter{data: data, writable: true}
+	err := filter.parseHeader()
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (self *BloomFilter) parseHeader() error {
+	data := self.data
+	if len(data) < bloomHeaderSize || !bytes.Equal(data[:4], bloomMagic) {
+		return fmt.Errorf("Invalid bloom filter")
+	}
+	self.k = binary.LittleEndian.Uint32(data[4:])
+	self.m = binary.LittleEndian.Uint64(data[8:])
+	self.bits = data[bloomHeaderSize:]
+	if self.m == 0 || uint64(len(self.bits))*8 < self.m {
+		return fmt.Errorf("Truncated bloom filter")
+	}
+	return nil
+}
+
+// Content of the filter, header included
+func (self *BloomFilter) Bytes() []byte {
+	return self.data
+}
+
+// Double hashing: the k positions are derived from two 32 bits
+// halves of a 64 bits hash.
+func (self *BloomFilter) positions(weak WeakHash, fn func(uint64) bool) bool {
+	// Inlined 64 bits FNV-1a over the little endian bytes of weak,
+	// the hash/fnv package would allocate on every call
+	sum := uint64(fnvOffset64)
+	for shift := uint(0); shift < 32; shift += 8 {
+		sum ^= uint64(byte(uint32(weak) >> shift))
+		sum *= fnvPrime64
+	}
+	h1 := sum & 0xffffffff
+	h2 := sum>>32 | 1
+	for i := uint64(0); i < uint64(self.k); i++ {
+		if !fn((h1 + i*h2) % self.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *BloomFilter) Add(weak WeakHash) {
+	added := false
+	self.positions(weak, func(pos uint64) bool {
+		mask := byte(1) << (pos % 8)
+		if self.bits[pos/8]&mask == 0 {
+			self.bits[pos/8] |= mask
+			added = true
+		}
+		return true
+	})
+	if added {
+		binary.LittleEndian.PutUint64(self.data[24:], self.Count()+1)
+	}
+}
+
+func (self *BloomFilter) Test(weak WeakHash) bool {
+	return self.positions(weak, func(pos uint64) bool {
+		return self.bits[pos/8]&(byte(1)<<(pos%8)) != 0
+	})
+}
+
+// Number of entries added (duplicates and collisions excluded)
+func (self *BloomFilter) Count() uint64 {
+	return binary.LittleEndian.Uint64(self.data[24:])
+}
+
+// Number of entries the filter was sized for
+func (self *BloomFilter) Capacity() uint64 {
+	return binary.LittleEndian.Uint64(self.data[16:])
+}
+
+func (self *BloomFilter) Close() error {
+	if self.file == nil {
+		// In-memory filter
+		return nil
+	}
+	err := unmapFile(self.file, self.data, self.writable)
+	if closeErr := self.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package enki
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"path"
+	"testing"
+)
+
+func TestBloomSize(t *testing.T) {
+	// Values from calculate_bloom.py
+	m, k := BloomSize(1<<23, 0.001)
+	if m != 120607952 || k != 10 {
+		t.Errorf("Unexpected size: m=%v k=%v", m, k)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "test.bloom")
+	capacity := uint64(10000)
+	bloom, err := OpenBloomFilter(filePath, capacity, 0.01)
+	check(err)
+	for i := uint64(0); i < capacity; i++ {
+		bloom.Add(WeakHash(i * 7919))
+	}
+	check(bloom.Close())
+
+	// Reopen, sizing arguments are ignored
+	bloom, err = OpenBloomFilter(filePath, 1, 0.5)
+	check(err)
+	defer bloom.Close()
+	if bloom.Capacity() != capacity {
+		t.Errorf("Unexpected capacity %v", bloom.Capacity())
+	}
+	for i := uint64(0); i < capacity; i++ {
+		if !bloom.Test(WeakHash(i * 7919)) {
+			t.Fatalf("Missing entry %v", i)
+		}
+	}
+	falsePositives := 0
+	for i := uint64(0); i < capacity; i++ {
+		if bloom.Test(WeakHash(i*7919 + 1)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > int(capacity)/50 {
+		t.Errorf("Too many false positives: %v", falsePositives)
+	}
+}
+
+func TestBloomPositions(t *testing.T) {
+	// Positions must not change, existing filters depend on them
+	bloom := &BloomFilter{k: 4, m: 1000003}
+	for _, weak := range []WeakHash{0, 1, 0xdeadbeef, 0xffffffff} {
+		key := make([]byte, 4)
+		binary.LittleEndian.PutUint32(key, uint32(weak))
+		hash := fnv.New64a()
+		hash.Write(key)
+		sum := hash.Sum64()
+		i := uint64(0)
+		bloom.positions(weak, func(pos uint64) bool {
+			expected := ((sum & 0xffffffff) + i*(sum>>32|1)) % bloom.m
+			if pos != expected {
+				t.Errorf("Unexpected position for %x: %v", weak, pos)
+			}
+			i++
+			return true
+		})
+	}
+}
+
+func BenchmarkBloomTest(b *testing.B) {
+	filePath := path.Join(b.TempDir(), "bench.bloom")
+	bloom, err := OpenBloomFilter(filePath, 1<<16, 0.01)
+	check(err)
+	defer bloom.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bloom.Test(WeakHash(i))
+	}
+}
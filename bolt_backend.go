@@ -2,98 +2,258 @@ package enki
 
 import (
 	"bytes"
-	"compress/lzw" // See also https://github.com/pierrec/lz4
 	"encoding/binary"
 	"encoding/gob"
 	"github.com/boltdb/bolt"
-	"io"
+	"log"
+	"math"
 	"os"
 	"path"
 )
 
 type BoltBackend struct {
-	weakMap         map[WeakHash]bool
-	blockFile       *BlobFile
-	sigFile         *BlobFile
+	bloom           *BloomFilter
+	blockFile       *PackStore
+	sigFile         *PackStore
 	db              *bolt.DB
 	dotDir          *string
 	stateBucket     *bolt.Bucket
+	metaBucket      *bolt.Bucket
 	tx              *bolt.Tx
+	readOnly        bool
 }
 
 func NewBoltBackend(dotDir string) Backend {
-	// Create weakMap
-	var err error
-	weakMap := make(map[WeakHash]bool)
-	mapPath := path.Join(dotDir, "weakmap.gob")
-	if fd, err := os.Open(mapPath); err == nil {
-		dec := gob.NewDecoder(fd)
-		err := dec.Decode(&weakMap)
-		check(err)
-	}
-	check(err)
-
 	// Create db
 	dbPath := path.Join(dotDir, "indexes.bolt")
 	db, err := bolt.Open(dbPath, 0600, nil)
 	check(err)
 
-	// Create buckets
+	// Create buckets (block and signature buckets are created by
+	// their pack stores)
 	tx, err := db.Begin(true)
 	check(err)
-	signatureBucket, err := tx.CreateBucketIfNotExists([]byte("signature"))
-	check(err)
 	stateBucket, err := tx.CreateBucketIfNotExists([]byte("state"))
 	check(err)
-	strongBucket, err := tx.CreateBucketIfNotExists([]byte("strong"))
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte("meta"))
 	check(err)
 
-	// Create blobfiles
-	var blockFile = NewBlobFile(path.Join(dotDir, "blocks.blob"), strongBucket)
-	var sigFile = NewBlobFile(path.Join(dotDir, "sigs.blob"), signatureBucket)
+	// Open bloom filter, it is created with the sizing given to the
+	// last rebuild if missing
+	capacity, fpRate := bloomSettings(metaBucket)
+	bloom, err := OpenBloomFilter(path.Join(dotDir, "weakmap.bloom"), capacity, fpRate)
+	check(err)
+	migrateWeakMap(dotDir, bloom)
+
+	// Open pack stores, and discard what a crashed process may have
+	// left behind
+	blockFile := NewPackStore(dotDir, "blocks", "strong", tx, false)
+	sigFile := NewPackStore(dotDir, "sigs", "signature", tx, false)
+
+	backend := &BoltBackend{
+		bloom,
+		blockFile,
+		sigFile,
+		db,
+		&dotDir,
+		stateBucket,
+		metaBucket,
+		tx,
+		false,
+	}
+	return backend
+}
+
+// Open the repository without ever writing to it: bolt is opened in
+// read-only mode (allowing concurrent readers) and every method that
+// would modify the repository panics.
+func NewReadOnlyBoltBackend(dotDir string) Backend {
+	var bloom *BloomFilter
+	bloomPath := path.Join(dotDir, "weakmap.bloom")
+	if _, err := os.Stat(bloomPath); err == nil {
+		bloom, err = openBloomFilter(bloomPath, false)
+		check(err)
+	}
+
+	dbPath := path.Join(dotDir, "indexes.bolt")
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true})
+	check(err)
+	tx, err := db.Begin(false)
+	check(err)
+	signatureBucket := tx.Bucket([]byte("signature"))
+	stateBucket := tx.Bucket([]byte("state"))
+	strongBucket := tx.Bucket([]byte("strong"))
+	if signatureBucket == nil || stateBucket == nil || strongBucket == nil {
+		tx.Rollback()
+		db.Close()
+		panic("Repository not initialized")
+	}
+	blockFile := NewPackStore(dotDir, "blocks", "strong", tx, true)
+	sigFile := NewPackStore(dotDir, "sigs", "signature", tx, true)
 
 	backend := &BoltBackend{
-		weakMap,
+		bloom,
 		blockFile,
 		sigFile,
 		db,
 		&dotDir,
 		stateBucket,
+		tx.Bucket([]byte("meta")),
 		tx,
+		true,
 	}
 	return backend
 }
 
+func (self *BoltBackend) checkWritable() {
+	if self.readOnly {
+		panic("Backend is read-only")
+	}
+}
+
+// Load the weak hashes of the legacy weakmap.gob file into the bloom
+// filter, and remove it.
+func migrateWeakMap(dotDir string, bloom *BloomFilter) {
+	mapPath := path.Join(dotDir, "weakmap.gob")
+	fd, err := os.Open(mapPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	check(err)
+	defer fd.Close()
+	weakMap := make(map[WeakHash]bool)
+	dec := gob.NewDecoder(fd)
+	check(dec.Decode(&weakMap))
+	for weak := range weakMap {
+		bloom.Add(weak)
+	}
+	check(os.Remove(mapPath))
+}
+
+// Packs are synced and their sizes recorded in the same
+// transaction as the indexes and the states, so a snapshot is either
+// fully committed or not at all. Anything written after the recorded
+// size is discarded on next open.
 func (self *BoltBackend) Close() {
+	if self.readOnly {
+		check(self.tx.Rollback())
+		check(self.db.Close())
+		if self.bloom != nil {
+			check(self.bloom.Close())
+		}
+		self.blockFile.Close()
+		self.sigFile.Close()
+		return
+	}
+	self.blockFile.Commit(self.metaBucket)
+	self.sigFile.Commit(self.metaBucket)
 	check(self.tx.Commit())
 	check(self.db.Close())
-	mapPath := path.Join(*self.dotDir, "weakmap.gob")
-	fd, err := os.Create(mapPath)
-	check(err)
-	defer fd.Close()
-	enc := gob.NewEncoder(fd)
-	check(enc.Encode(self.weakMap))
+	if self.bloom.Count() > self.bloom.Capacity() {
+		log.Print("Bloom filter is over capacity, run 'nk rebuild-bloom'")
+	}
+	check(self.bloom.Close())
 	self.blockFile.Close()
 	self.sigFile.Close()
 }
 
+func (self *BoltBackend) WeakFilter() []byte {
+	if self.bloom == nil {
+		return nil
+	}
+	return concat(self.bloom.Bytes())
+}
+
+// Commit everything written so far and start a new transaction
+func (self *BoltBackend) Checkpoint() {
+	self.checkWritable()
+	self.blockFile.Commit(self.metaBucket)
+	self.sigFile.Commit(self.metaBucket)
+	check(self.tx.Commit())
+	tx, err := self.db.Begin(true)
+	check(err)
+	self.tx = tx
+	self.blockFile.Bind(tx)
+	self.sigFile.Bind(tx)
+	self.stateBucket = tx.Bucket([]byte("state"))
+	self.metaBucket = tx.Bucket([]byte("meta"))
+}
+
+// Returns the capacity and false positive rate of the bloom filter,
+// as given to the last rebuild (the defaults if it was never rebuilt)
+func bloomSettings(metaBucket *bolt.Bucket) (uint64, float64) {
+	value := metaBucket.Get([]byte("bloom"))
+	if len(value) != 16 {
+		return DefaultBloomCapacity, DefaultBloomFPRate
+	}
+	return binary.LittleEndian.Uint64(value),
+		math.Float64frombits(binary.LittleEndian.Uint64(value[8:]))
+}
+
+// Replace the bloom filter with a new one sized for the given number
+// of entries (twice the number of known blocks if zero) and false
+// positive rate (the current one if zero). The weak hashes are
+// recomputed from the blocks themselves. The sizing is recorded, and
+// used if the filter has to be created again.
+func (self *BoltBackend) RebuildBloom(capacity uint64, fpRate float64) {
+	self.checkWritable()
+	if capacity == 0 {
+		capacity = 2 * uint64(self.blockFile.bucket.Stats().KeyN)
+	}
+	if fpRate == 0 {
+		_, fpRate = bloomSettings(self.metaBucket)
+	}
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, capacity)
+	binary.LittleEndian.PutUint64(value[8:], math.Float64bits(fpRate))
+	check(self.metaBucket.Put([]byte("bloom"), value))
+	bloomPath := path.Join(*self.dotDir, "weakmap.bloom")
+	tmpPath := bloomPath + ".tmp"
+	bloom, err := CreateBloomFilter(tmpPath, capacity, fpRate)
+	check(err)
+	cursor := self.blockFile.bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		weak, _, _ := GetWeakHash(self.blockFile.Read(key))
+		bloom.Add(weak)
+	}
+	check(self.bloom.Close())
+	check(os.Rename(tmpPath, bloomPath))
+	self.bloom = bloom
+}
+
+// Discard everything written since last commit and close the backend.
+// Data already appended to the packs is truncated on next open.
 func (self *BoltBackend) Abort() {
 	self.tx.Rollback()
+	check(self.db.Close())
+	if self.bloom != nil {
+		check(self.bloom.Close())
+	}
+	self.blockFile.Close()
+	self.sigFile.Close()
 }
 
 func (self *BoltBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	self.checkWritable()
 	// Store block
-	self.blockFile.Write(strong[:], data)
-	// Update map
-	self.weakMap[weak] = true
+	self.blockFile.Write(strong[:], weak, data)
+	// Update bloom filter
+	self.bloom.Add(weak)
 }
 
 func (self *BoltBackend) ReadStrong(strong *StrongHash) Block {
 	return self.blockFile.Read(strong[:])
 }
 
+func (self *BoltBackend) HasBlock(strong *StrongHash) bool {
+	return self.blockFile.Has(strong[:])
+}
+
 func (self *BoltBackend) SearchWeak(weak WeakHash) bool {
-	return self.weakMap[weak]
+	if self.bloom == nil {
+		return false
+	}
+	return self.bloom.Test(weak)
 }
 
 func (self *BoltBackend) ReadSignature(checksum []byte) *Signature {
@@ -108,9 +268,10 @@ func (self *BoltBackend) ReadSignature(checksum []byte) *Signature {
 }
 
 func (self *BoltBackend) WriteSignature(checksum []byte, sgn *Signature) {
+	self.checkWritable()
 	data, err := sgn.GobEncode()
 	check(err)
-	self.sigFile.Write(checksum, data)
+	self.sigFile.Write(checksum, 0, data)
 }
 
 func (self *BoltBackend) ReadState(timestamp int64) *DirState {
@@ -136,82 +297,10 @@ func (self *BoltBackend) ReadState(timestamp int64) *DirState {
 }
 
 func (self *BoltBackend) WriteState(state *DirState) {
+	self.checkWritable()
 	// Key is encoded with big endianess to preserve ordering
 	key := make([]byte, 8)
 	binary.BigEndian.PutUint64(key, uint64(state.Timestamp))
 	data := state.GobEncode()
 	self.stateBucket.Put(key, data)
 }
-
-
-type BlobFile struct {
-	file *os.File
-	bucket *bolt.Bucket
-}
-
-func NewBlobFile(filePath string, bucket *bolt.Bucket) *BlobFile {
-	var file *os.File
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
-	check(err)
-	return &BlobFile{file, bucket}
-}
-
-
-func (self *BlobFile) Write(key []byte, data []byte) {
-	// Write the size of (zipped) data and (zipped) data  at the end of
-	// file. Take the offset of data in the file and put it in the
-	// bucket under the given key
-
-	value := self.bucket.Get(key)
-	if value != nil {
-		// Key already known, nothing to do
-		return
-	}
-
-	// Store future data position (current file size) in bucket
-	position := make([]byte, 8)
-	size, err := self.file.Seek(0, os.SEEK_END)
-	check(err)
-	binary.LittleEndian.PutUint64(position, uint64(size))
-	self.bucket.Put(key, position)
-
-	// Write data size
-	data_size := make([]byte, 4)
-	binary.LittleEndian.PutUint32(data_size, uint32(len(data)))
-	_, err = self.file.Write(data_size)
-	check(err)
-
-	// Zip+Write data
-	zip_writer := lzw.NewWriter(self.file, lzw.LSB, 8)
-	_, err = zip_writer.Write(data)
-	check(err)
-	zip_writer.Close()
-}
-
-func (self *BlobFile) Read(key []byte) []byte {
-	// Unknown key, return nil
-	bpos := self.bucket.Get(key)
-	if bpos == nil {
-		return nil
-	}
-
-	// Seek to the position stored in bucket
-	position := binary.LittleEndian.Uint64(bpos)
-	self.file.Seek(int64(position), os.SEEK_SET)
-
-	// The first 4 bytes encode the size of the following block
-	value := make([]byte, 4)
-	_, err := self.file.Read(value)
-	check(err)
-	dataSize := binary.LittleEndian.Uint32(value)
-
-	data := make([]byte, dataSize)
-	zip_reader := lzw.NewReader(self.file, lzw.LSB, 8)
-	_, err = io.ReadFull(zip_reader, data)
-	check(err)
-	return data
-}
-
-func (self *BlobFile) Close() {
-	check(self.file.Close())
-}
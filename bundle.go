@@ -0,0 +1,387 @@
+package enki
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// A bundle holds the states added to a repository since a base state,
+// with the signatures and blocks they need, so they can be moved to
+// another repository without a network connection.
+//
+// It is a sequence of records: a kind byte, a key and a payload, both
+// prefixed by their length (as uvarint). The file starts with a magic
+// string and a header record, and ends with a record holding the md5
+// of everything before it.
+const bundleMagic = "NKBUNDLE1"
+
+// Record kinds
+const (
+	headerRecord    = 'H'
+	blockRecord     = 'B'
+	signatureRecord = 'S'
+	stateRecord     = 'T'
+	endRecord       = 'E'
+)
+
+type BundleHeader struct {
+	// Timestamp and checksum of the state the bundle is based on, zero
+	// for a bundle holding the whole repository
+	Base         int64
+	BaseChecksum []byte
+	Created      int64
+}
+
+// Write in w the states of backend that are newer than the one at
+// since (zero for all of them), with the signatures and blocks not
+// already referenced by that base state.
+func WriteBundle(backend Backend, since int64, w io.Writer) (stats ReplicateStats, err error) {
+	defer recoverError(&err)
+	self := &bundleWriter{
+		backend:         backend,
+		w:               bufio.NewWriter(w),
+		hash:            md5.New(),
+		knownBlocks:     make(map[StrongHash]bool),
+		knownSignatures: make(map[string]bool),
+	}
+	header := BundleHeader{Created: time.Now().Unix()}
+	if since != 0 {
+		base := backend.ReadState(since)
+		if base == nil {
+			return stats, fmt.Errorf("No snapshot found at %v", since)
+		}
+		header.Base = base.Timestamp
+		header.BaseChecksum = base.Checksum()
+		// The target is known to hold everything the base references
+		for _, fst := range base.FileStates {
+			self.walkSignature(fst.SgnSum, false)
+		}
+	}
+
+	var timestamps []int64
+	for state := LastState(backend); state != nil && state.Timestamp > header.Base; state = backend.ReadState(state.Timestamp - 1) {
+		timestamps = append(timestamps, state.Timestamp)
+	}
+	if len(timestamps) == 0 {
+		return stats, errors.New("No snapshot to bundle")
+	}
+
+	self.hash.Write([]byte(bundleMagic))
+	_, err = self.w.WriteString(bundleMagic)
+	check(err)
+	var buf bytes.Buffer
+	check(gob.NewEncoder(&buf).Encode(header))
+	self.record(headerRecord, nil, buf.Bytes())
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		state := backend.ReadState(timestamps[i])
+		var names []string
+		for name := range state.FileStates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			self.walkSignature(state.FileStates[name].SgnSum, true)
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(state.Timestamp))
+		self.record(stateRecord, key, state.GobEncode())
+		self.stats.States++
+	}
+
+	self.record(endRecord, nil, self.hash.Sum(nil))
+	return self.stats, self.w.Flush()
+}
+
+type bundleWriter struct {
+	backend Backend
+	w       *bufio.Writer
+	hash    hash.Hash
+	// Blocks and signatures already written, or referenced by the
+	// base. Both are md5 sums, and the signature of a file holding a
+	// single block has the checksum of that block, so they are kept
+	// apart.
+	knownBlocks     map[StrongHash]bool
+	knownSignatures map[string]bool
+	stats           ReplicateStats
+}
+
+// Mark the signature and everything it references as known, writing
+// them first if write is set. Blocks are written before the signatures
+// referencing them.
+func (self *bundleWriter) walkSignature(checksum []byte, write bool) {
+	if self.knownSignatures[string(checksum)] {
+		return
+	}
+	sgn := self.backend.ReadSignature(checksum)
+	if sgn == nil {
+		panic(fmt.Sprintf("Signature %x not found", checksum))
+	}
+	for _, segment := range sgn.Segments {
+		switch segment.Mode {
+		case HASH_SGM:
+			if self.knownBlocks[*segment.Stronghash] {
+				continue
+			}
+			self.knownBlocks[*segment.Stronghash] = true
+			if !write {
+				continue
+			}
+			data := self.backend.ReadStrong(segment.Stronghash)
+			if data == nil {
+				panic(fmt.Sprintf("Block %x not found", segment.Stronghash[:]))
+			}
+			weak, _, _ := GetWeakHash(data)
+			key := make([]byte, 4, 4+StrongHashSize)
+			binary.BigEndian.PutUint32(key, uint32(weak))
+			self.record(blockRecord, append(key, segment.Stronghash[:]...), data)
+			self.stats.Blocks++
+		case INDEX_SGM:
+			self.walkSignature(segment.Stronghash[:], write)
+		}
+	}
+	self.knownSignatures[string(checksum)] = true
+	if write {
+		data, err := sgn.GobEncode()
+		check(err)
+		self.record(signatureRecord, checksum, data)
+		self.stats.Signatures++
+	}
+}
+
+func (self *bundleWriter) record(kind byte, key, payload []byte) {
+	self.writeByte(kind)
+	self.writeBytes(key)
+	self.writeBytes(payload)
+}
+
+func (self *bundleWriter) writeByte(b byte) {
+	self.hash.Write([]byte{b})
+	check(self.w.WriteByte(b))
+}
+
+func (self *bundleWriter) writeBytes(data []byte) {
+	size := binary.AppendUvarint(nil, uint64(len(data)))
+	self.hash.Write(size)
+	self.hash.Write(data)
+	_, err := self.w.Write(size)
+	check(err)
+	_, err = self.w.Write(data)
+	check(err)
+}
+
+// Bundle is a read-only Backend over a bundle file, to be replicated
+// in another repository with ApplyBundle
+type Bundle struct {
+	Header BundleHeader
+	file   *os.File
+	// Position and size of the payload of each record
+	blocks     map[StrongHash][2]int64
+	weaks      map[WeakHash]bool
+	signatures map[string][2]int64
+	states     map[int64][2]int64
+	timestamps []int64
+}
+
+// Open a bundle file, its integrity is verified before it is indexed
+func OpenBundle(path string) (*Bundle, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	self := &Bundle{
+		file:       fd,
+		blocks:     make(map[StrongHash][2]int64),
+		weaks:      make(map[WeakHash]bool),
+		signatures: make(map[string][2]int64),
+		states:     make(map[int64][2]int64),
+	}
+	if err = self.index(); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("Invalid bundle %v: %v", path, err)
+	}
+	return self, nil
+}
+
+func (self *Bundle) index() (err error) {
+	defer recoverError(&err)
+	r := &bundleReader{r: bufio.NewReader(self.file), hash: md5.New()}
+	magic := make([]byte, len(bundleMagic))
+	r.read(magic)
+	if string(magic) != bundleMagic {
+		return errors.New("Not a bundle")
+	}
+	for kind := r.readByte(); kind != endRecord; kind = r.readByte() {
+		key := r.readBytes()
+		payload := r.readBytes()
+		pos := [2]int64{r.offset - int64(len(payload)), int64(len(payload))}
+		switch kind {
+		case headerRecord:
+			check(gob.NewDecoder(bytes.NewReader(payload)).Decode(&self.Header))
+		case blockRecord:
+			if len(key) != 4+StrongHashSize {
+				return errors.New("Invalid block key")
+			}
+			var strong StrongHash
+			copy(strong[:], key[4:])
+			self.blocks[strong] = pos
+			self.weaks[WeakHash(binary.BigEndian.Uint32(key))] = true
+		case signatureRecord:
+			self.signatures[string(key)] = pos
+		case stateRecord:
+			if len(key) != 8 {
+				return errors.New("Invalid state key")
+			}
+			ts := int64(binary.BigEndian.Uint64(key))
+			self.states[ts] = pos
+			self.timestamps = append(self.timestamps, ts)
+		default:
+			return fmt.Errorf("Unknown record %q", kind)
+		}
+	}
+	// The end record holds the md5 of everything before it
+	sum := r.hash.Sum(nil)
+	r.readBytes()
+	if !bytes.Equal(r.readBytes(), sum) {
+		return errors.New("Checksum mismatch")
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("Unexpected data after the end")
+	}
+	sort.Slice(self.timestamps, func(i, j int) bool {
+		return self.timestamps[i] < self.timestamps[j]
+	})
+	return nil
+}
+
+func (self *Bundle) payload(pos [2]int64) []byte {
+	data := make([]byte, pos[1])
+	_, err := self.file.ReadAt(data, pos[0])
+	check(err)
+	return data
+}
+
+func (self *Bundle) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	panic("Bundles are read-only")
+}
+
+func (self *Bundle) SearchWeak(weak WeakHash) bool {
+	return self.weaks[weak]
+}
+
+func (self *Bundle) ReadStrong(strong *StrongHash) Block {
+	pos, ok := self.blocks[*strong]
+	if !ok {
+		return nil
+	}
+	return self.payload(pos)
+}
+
+func (self *Bundle) ReadSignature(checksum []byte) *Signature {
+	pos, ok := self.signatures[string(checksum)]
+	if !ok {
+		return nil
+	}
+	sgn := &Signature{}
+	check(sgn.GobDecode(self.payload(pos)))
+	return sgn
+}
+
+func (self *Bundle) WriteSignature(checksum []byte, sgn *Signature) {
+	panic("Bundles are read-only")
+}
+
+// Returns the nearest state at or before timestamp
+func (self *Bundle) ReadState(timestamp int64) *DirState {
+	idx := sort.Search(len(self.timestamps), func(i int) bool {
+		return self.timestamps[i] > timestamp
+	})
+	if idx == 0 {
+		return nil
+	}
+	state := &DirState{}
+	state.GobDecode(self.payload(self.states[self.timestamps[idx-1]]))
+	return state
+}
+
+func (self *Bundle) WriteState(state *DirState) {
+	panic("Bundles are read-only")
+}
+
+func (self *Bundle) Close() {
+	self.file.Close()
+}
+
+// Copy the content of the bundle in dst, which must hold the base
+// state of the bundle
+func ApplyBundle(bundle *Bundle, dst Backend) (ReplicateStats, error) {
+	if bundle.Header.Base != 0 {
+		base := dst.ReadState(bundle.Header.Base)
+		if base == nil || base.Timestamp != bundle.Header.Base {
+			return ReplicateStats{}, fmt.Errorf("Base snapshot %v is missing from the repository",
+				bundle.Header.Base)
+		}
+		if !bytes.Equal(base.Checksum(), bundle.Header.BaseChecksum) {
+			return ReplicateStats{}, fmt.Errorf("Base snapshot %v differs from the one of the bundle",
+				bundle.Header.Base)
+		}
+	}
+	return Replicate(bundle, dst)
+}
+
+// Reads records while computing the md5 of what is read
+type bundleReader struct {
+	r      *bufio.Reader
+	hash   hash.Hash
+	offset int64
+}
+
+func (self *bundleReader) read(data []byte) {
+	_, err := io.ReadFull(self.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	check(err)
+	self.hash.Write(data)
+	self.offset += int64(len(data))
+}
+
+// The kind of the end record is not part of the md5
+func (self *bundleReader) readByte() byte {
+	b, err := self.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	check(err)
+	self.offset++
+	if b != endRecord {
+		self.hash.Write([]byte{b})
+	}
+	return b
+}
+
+func (self *bundleReader) readBytes() []byte {
+	size, err := binary.ReadUvarint(self.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	check(err)
+	varint := binary.AppendUvarint(nil, size)
+	self.hash.Write(varint)
+	self.offset += int64(len(varint))
+	if size > 1<<30 {
+		panic("Record too large")
+	}
+	data := make([]byte, size)
+	self.read(data)
+	return data
+}
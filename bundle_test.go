@@ -0,0 +1,115 @@
+package enki
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := NewMemoryBackend()
+	snapshot := func(i int, content []byte) *DirState {
+		check(os.WriteFile(path.Join(root, "file.data"), content, 0644))
+		state := NewDirState(root, src, LastState(src))
+		state.Timestamp += int64(i)
+		state.Snapshot()
+		return state
+	}
+	base := snapshot(0, data)
+	dst := NewMemoryBackend()
+	_, err := Replicate(src, dst)
+	check(err)
+
+	// Two new snapshots, each changing a few bytes
+	copy(data[1000:], "first change")
+	snapshot(1, data)
+	copy(data[500000:], "second change")
+	last := snapshot(2, data)
+
+	bundlePath := path.Join(t.TempDir(), "changes.bundle")
+	fd, err := os.Create(bundlePath)
+	check(err)
+	stats, err := WriteBundle(src, base.Timestamp, fd)
+	check(err)
+	check(fd.Close())
+	if stats.States != 2 || stats.Blocks == 0 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+	info, err := os.Stat(bundlePath)
+	check(err)
+	if info.Size() > int64(len(data))/4 {
+		t.Errorf("Bundle too big: %v bytes", info.Size())
+	}
+
+	bundle, err := OpenBundle(bundlePath)
+	check(err)
+	defer bundle.Close()
+	// The base is required
+	if _, err := ApplyBundle(bundle, NewMemoryBackend()); err == nil {
+		t.Errorf("Bundle applied without its base")
+	}
+	stats, err = ApplyBundle(bundle, dst)
+	check(err)
+	if stats.States != 2 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+	var buf bytes.Buffer
+	check(NewBlob(dst).Restore(last.FileStates["file.data"].SgnSum, &buf))
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Content mismatch")
+	}
+
+	// Corrupted bundles are rejected
+	content, err := os.ReadFile(bundlePath)
+	check(err)
+	content[len(content)/2] ^= 1
+	check(os.WriteFile(bundlePath, content, 0644))
+	if _, err := OpenBundle(bundlePath); err == nil {
+		t.Errorf("Corrupted bundle accepted")
+	}
+	check(os.WriteFile(bundlePath, content[:len(content)-10], 0644))
+	if _, err := OpenBundle(bundlePath); err == nil {
+		t.Errorf("Truncated bundle accepted")
+	}
+}
+
+func TestBundleSingleBlockFile(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := NewMemoryBackend()
+	check(os.WriteFile(path.Join(root, "big.bin"), data, 0644))
+	base := NewDirState(root, src, nil)
+	base.Snapshot()
+	dst := NewMemoryBackend()
+	_, err := Replicate(src, dst)
+	check(err)
+
+	// The signature of a file made of one block has the checksum of
+	// that block, which is already known from the base
+	check(os.WriteFile(path.Join(root, "head.bin"), data[:8192], 0644))
+	last := NewDirState(root, src, base)
+	last.Timestamp = base.Timestamp + 1
+	last.Snapshot()
+
+	var buf bytes.Buffer
+	_, err = WriteBundle(src, base.Timestamp, &buf)
+	check(err)
+	bundlePath := path.Join(t.TempDir(), "head.bundle")
+	check(os.WriteFile(bundlePath, buf.Bytes(), 0644))
+	bundle, err := OpenBundle(bundlePath)
+	check(err)
+	defer bundle.Close()
+	_, err = ApplyBundle(bundle, dst)
+	check(err)
+	buf.Reset()
+	check(NewBlob(dst).Restore(last.FileStates["head.bin"].SgnSum, &buf))
+	if !bytes.Equal(buf.Bytes(), data[:8192]) {
+		t.Errorf("Content mismatch")
+	}
+}
@@ -0,0 +1,84 @@
+// Package fakes3 provides an in-process stand-in for an S3 server,
+// supporting just what enki.S3Client needs.
+package fakes3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Server keeps objects in memory, and counts the range requests so
+// that tests can check how often pack data is fetched. Only signed
+// requests are accepted, signatures are not verified.
+type Server struct {
+	Objects map[string][]byte
+	Ranges  int
+	mutex   sync.Mutex
+}
+
+type listResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct{ Key string }
+}
+
+func NewServer() *Server {
+	return &Server{Objects: make(map[string][]byte)}
+}
+
+func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 && r.Method == "GET" {
+		// ListObjectsV2 without pagination
+		prefix := r.URL.Query().Get("prefix")
+		var keys []string
+		for key := range self.Objects {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		result := listResult{}
+		for _, key := range keys {
+			result.Contents = append(result.Contents, struct{ Key string }{key})
+		}
+		data, _ := xml.Marshal(result)
+		w.Write(data)
+		return
+	}
+	key := parts[1]
+	switch r.Method {
+	case "PUT":
+		data := new(bytes.Buffer)
+		data.ReadFrom(r.Body)
+		self.Objects[key] = data.Bytes()
+	case "GET":
+		data, present := self.Objects[key]
+		if !present {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); n == 2 {
+			self.Ranges++
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start : end+1]
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,255 @@
+// Package enkitest provides a conformance suite for implementations of
+// enki.Backend.
+package enkitest
+
+import (
+	"bitbucket.org/bertrandchenal/enki"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Factory opens the backend stored in dir. The suite calls it more than
+// once with the same directory (after closing the previous backend) to
+// check that the content is persisted.
+type Factory func(t *testing.T, dir string) enki.Backend
+
+// Run every conformance test against the backends returned by open
+func RunBackendSuite(t *testing.T, open Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, Factory)
+	}{
+		{"Dedup", testDedup},
+		{"WeakLookup", testWeakLookup},
+		{"Missing", testMissing},
+		{"Signature", testSignature},
+		{"Restore", testRestore},
+		{"State", testState},
+		{"NearestState", testNearestState},
+		{"Reopen", testReopen},
+		{"Concurrency", testConcurrency},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, open)
+		})
+	}
+}
+
+// Returns a block of random data (always the same for a given seed)
+func randomBlock(seed int64, size int) enki.Block {
+	block := make(enki.Block, size)
+	rand.New(rand.NewSource(seed)).Read(block)
+	return block
+}
+
+func addBlock(backend enki.Backend, block enki.Block) (enki.WeakHash, *enki.StrongHash) {
+	weak, _, _ := enki.GetWeakHash(block)
+	strong := enki.GetStrongHash(block)
+	backend.AddBlock(weak, strong, block)
+	return weak, strong
+}
+
+func testDedup(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	block := randomBlock(1, 8192)
+	weak, strong := addBlock(backend, block)
+	// A second block with the same strong hash is ignored
+	backend.AddBlock(weak, strong, randomBlock(2, 8192))
+	addBlock(backend, block)
+	if !bytes.Equal(backend.ReadStrong(strong), block) {
+		t.Errorf("Block not deduplicated")
+	}
+}
+
+func testWeakLookup(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	block := randomBlock(1, 8192)
+	weak, _ := addBlock(backend, block)
+	if !backend.SearchWeak(weak) {
+		t.Errorf("Weak hash of added block not found")
+	}
+	other, _, _ := enki.GetWeakHash(randomBlock(2, 8192))
+	if backend.SearchWeak(other) {
+		t.Errorf("Weak hash of unknown block found")
+	}
+}
+
+func testMissing(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	if backend.ReadStrong(enki.GetStrongHash(randomBlock(1, 10))) != nil {
+		t.Errorf("Unknown block found")
+	}
+	if backend.ReadSignature([]byte("unknown checksum")) != nil {
+		t.Errorf("Unknown signature found")
+	}
+	if enki.LastState(backend) != nil {
+		t.Errorf("State found in empty backend")
+	}
+}
+
+func testSignature(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	sgn := &enki.Signature{}
+	block := randomBlock(1, 8192)
+	weak, strong := addBlock(backend, block)
+	sgn.AddHash(weak, strong, int64(len(block)))
+	sgn.AddData([]byte("literal data"))
+	sgn.AddHash(weak, strong, int64(len(block)))
+	backend.WriteSignature([]byte("checksum"), sgn)
+
+	found := backend.ReadSignature([]byte("checksum"))
+	if found == nil {
+		t.Fatalf("Signature not found")
+	}
+	if !reflect.DeepEqual(found.Segments, sgn.Segments) {
+		t.Errorf("Signature segments differ")
+	}
+}
+
+func testRestore(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	blob := enki.NewBlob(backend)
+	data := randomBlock(1, 1<<20)
+	// Repeated content, so that some blocks are matched while rolling
+	data = append(data, data[1000:300000]...)
+	sgn := blob.Snapshot(bytes.NewReader(data), int64(len(data)))
+	backend.WriteSignature([]byte("checksum"), sgn)
+
+	var buf bytes.Buffer
+	err := blob.Restore([]byte("checksum"), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Restored data differ")
+	}
+}
+
+func testState(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	state := &enki.DirState{
+		Timestamp: 1432808440,
+		FileStates: map[string]enki.FileState{
+			"a.txt":     {Timestamp: 1432808000, SgnSum: []byte("sum-a"), Size: 10},
+			"dir/b.txt": {Timestamp: 1432808001, SgnSum: []byte("sum-b"), Size: 20},
+		},
+	}
+	backend.WriteState(state)
+	found := backend.ReadState(state.Timestamp)
+	if found == nil {
+		t.Fatalf("State not found")
+	}
+	if found.Timestamp != state.Timestamp {
+		t.Errorf("Unexpected timestamp %v", found.Timestamp)
+	}
+	if !reflect.DeepEqual(found.FileStates, state.FileStates) {
+		t.Errorf("File states differ")
+	}
+}
+
+func testNearestState(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	for _, ts := range []int64{300, 100, 200} {
+		backend.WriteState(&enki.DirState{Timestamp: ts})
+	}
+	expected := map[int64]int64{
+		99:                0,
+		100:               100,
+		199:               100,
+		250:               200,
+		300:               300,
+		301:               300,
+		enki.MAXTIMESTAMP: 300,
+	}
+	for query, ts := range expected {
+		found := backend.ReadState(query)
+		if ts == 0 {
+			if found != nil {
+				t.Errorf("ReadState(%v): unexpected state %v", query, found.Timestamp)
+			}
+			continue
+		}
+		if found == nil {
+			t.Errorf("ReadState(%v): state not found", query)
+		} else if found.Timestamp != ts {
+			t.Errorf("ReadState(%v): found %v instead of %v", query, found.Timestamp, ts)
+		}
+	}
+}
+
+func testReopen(t *testing.T, open Factory) {
+	dir := t.TempDir()
+	backend := open(t, dir)
+	block := randomBlock(1, 8192)
+	weak, strong := addBlock(backend, block)
+	sgn := &enki.Signature{}
+	sgn.AddHash(weak, strong, int64(len(block)))
+	backend.WriteSignature([]byte("checksum"), sgn)
+	backend.WriteState(&enki.DirState{Timestamp: 1432808440})
+	backend.Close()
+
+	backend = open(t, dir)
+	defer backend.Close()
+	if !backend.SearchWeak(weak) {
+		t.Errorf("Weak hash lost")
+	}
+	if !bytes.Equal(backend.ReadStrong(strong), block) {
+		t.Errorf("Block lost")
+	}
+	if backend.ReadSignature([]byte("checksum")) == nil {
+		t.Errorf("Signature lost")
+	}
+	state := enki.LastState(backend)
+	if state == nil || state.Timestamp != 1432808440 {
+		t.Errorf("State lost")
+	}
+}
+
+// Backends are used concurrently through a SyncBackend (see
+// ScanOptions.Jobs)
+func testConcurrency(t *testing.T, open Factory) {
+	backend := open(t, t.TempDir())
+	defer backend.Close()
+	synced := enki.NewSyncBackend(backend)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			// Workers share half of their blocks
+			for i := 0; i < 20; i++ {
+				seed := int64(worker*10 + i)
+				block := randomBlock(seed, 1024)
+				weak, strong := addBlock(synced, block)
+				if !synced.SearchWeak(weak) || !bytes.Equal(synced.ReadStrong(strong), block) {
+					errs <- fmt.Errorf("Block %v not found", seed)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for seed := int64(0); seed < 90; seed++ {
+		if backend.ReadStrong(enki.GetStrongHash(randomBlock(seed, 1024))) == nil {
+			t.Errorf("Block %v lost", seed)
+		}
+	}
+}
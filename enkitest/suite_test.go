@@ -0,0 +1,61 @@
+package enkitest
+
+import (
+	"bitbucket.org/bertrandchenal/enki"
+	"bitbucket.org/bertrandchenal/enki/enkitest/fakes3"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBoltBackend(t *testing.T) {
+	RunBackendSuite(t, func(t *testing.T, dir string) enki.Backend {
+		return enki.NewBoltBackend(dir)
+	})
+}
+
+func TestSQLiteBackend(t *testing.T) {
+	RunBackendSuite(t, func(t *testing.T, dir string) enki.Backend {
+		return enki.NewSQLiteBackend(path.Join(dir, "repo.db"))
+	})
+}
+
+// Every directory gets its own server, kept alive across reopens
+func TestHTTPBackend(t *testing.T) {
+	servers := make(map[string]*httptest.Server)
+	RunBackendSuite(t, func(t *testing.T, dir string) enki.Backend {
+		server, ok := servers[dir]
+		if !ok {
+			dotDir := path.Join(dir, ".nk")
+			if err := os.Mkdir(dotDir, 0750); err != nil {
+				t.Fatal(err)
+			}
+			backend := enki.NewBoltBackend(dotDir)
+			server = httptest.NewServer(enki.NewBackendServer(backend))
+			servers[dir] = server
+			t.Cleanup(func() {
+				server.Close()
+				backend.Close()
+			})
+		}
+		return enki.NewHTTPBackend(server.URL)
+	})
+}
+
+// Every directory gets its own prefix in a shared bucket, and its own
+// index cache
+func TestS3Backend(t *testing.T) {
+	server := httptest.NewServer(fakes3.NewServer())
+	defer server.Close()
+	client := enki.NewS3Client(server.URL, "bucket", "", "key", "secret")
+	RunBackendSuite(t, func(t *testing.T, dir string) enki.Backend {
+		return enki.NewS3Backend(client, dir, path.Join(dir, "cache"))
+	})
+}
+
+func TestMemoryBackend(t *testing.T) {
+	RunBackendSuite(t, func(t *testing.T, dir string) enki.Backend {
+		return enki.OpenMemoryBackend(path.Join(dir, "backend.gob"))
+	})
+}
@@ -0,0 +1,148 @@
+package enki
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	TAR_FORMAT    = iota
+	TAR_GZ_FORMAT = iota
+	ZIP_FORMAT    = iota
+)
+
+type ExportOptions struct {
+	Format int
+	// Only export the files matching (or contained in) one of those
+	// paths, everything is exported if empty
+	Paths []string
+}
+
+// Returns the archive format matching the given name (tar, tar.gz,
+// tgz or zip)
+func ParseArchiveFormat(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "tar":
+		return TAR_FORMAT, nil
+	case "tar.gz", "tgz":
+		return TAR_GZ_FORMAT, nil
+	case "zip":
+		return ZIP_FORMAT, nil
+	}
+	return 0, fmt.Errorf("Unknown archive format '%v'", name)
+}
+
+// Write the files of the given state in an archive. Files are
+// extracted one after the other straight into w, so the archive can be
+// streamed.
+func ExportState(backend Backend, state *DirState, w io.Writer, options ExportOptions) error {
+	var names []string
+	for name := range state.FileStates {
+		if matchPaths(name, options.Paths) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	blob := NewBlob(backend)
+
+	switch options.Format {
+	case TAR_FORMAT, TAR_GZ_FORMAT:
+		var gz *gzip.Writer
+		if options.Format == TAR_GZ_FORMAT {
+			gz = gzip.NewWriter(w)
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		for _, name := range names {
+			err := exportTarFile(blob, tw, name, state.FileStates[name])
+			if err != nil {
+				return err
+			}
+		}
+		err := tw.Close()
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		return err
+	case ZIP_FORMAT:
+		zw := zip.NewWriter(w)
+		for _, name := range names {
+			fst := state.FileStates[name]
+			header := &zip.FileHeader{
+				Name:     filepath.ToSlash(name),
+				Method:   zip.Deflate,
+				Modified: fst.ModTime(),
+			}
+			header.SetMode(fst.FileMode())
+			fw, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			err = blob.Restore(fst.SgnSum, fw)
+			if err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	return fmt.Errorf("Unknown archive format %v", options.Format)
+}
+
+func exportTarFile(blob *Blob, tw *tar.Writer, name string, fst FileState) error {
+	size := fst.Size
+	if size == 0 {
+		// States recorded before sizes were, the file has to be
+		// extracted once to know it
+		counter := &countWriter{}
+		err := blob.Restore(fst.SgnSum, counter)
+		if err != nil {
+			return err
+		}
+		size = counter.count
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Size:     size,
+		Mode:     int64(fst.FileMode()),
+		ModTime:  fst.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	err := tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	// The tar writer fails if the content does not match the size
+	// given in the header
+	return blob.Restore(fst.SgnSum, tw)
+}
+
+// Returns true if name is one of paths or is contained in one of them
+func matchPaths(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	name = filepath.ToSlash(name)
+	for _, p := range paths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if p == "." || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type countWriter struct {
+	count int64
+}
+
+func (self *countWriter) Write(data []byte) (int, error) {
+	self.count += int64(len(data))
+	return len(data), nil
+}
@@ -0,0 +1,99 @@
+package enki
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestExportState(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "first file",
+		"dir/b.txt":     "second file",
+		"dir/sub/c.txt": "third file",
+		"other/d.txt":   "fourth file",
+	}
+	mtime := time.Unix(1432808440, 0)
+	for name, content := range files {
+		abspath := path.Join(root, name)
+		check(os.MkdirAll(path.Dir(abspath), 0750))
+		check(os.WriteFile(abspath, []byte(content), 0644))
+		check(os.Chtimes(abspath, mtime, mtime))
+	}
+	check(os.Chmod(path.Join(root, "dir/b.txt"), 0750))
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	// States recorded before sizes were
+	fst := state.FileStates["a.txt"]
+	fst.Size = 0
+	state.FileStates["a.txt"] = fst
+
+	var buf bytes.Buffer
+	check(ExportState(backend, state, &buf, ExportOptions{Format: TAR_FORMAT}))
+	found := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+		data, err := io.ReadAll(tr)
+		check(err)
+		found[header.Name] = string(data)
+		if !header.ModTime.Equal(mtime) {
+			t.Errorf("Unexpected mtime for %v: %v", header.Name, header.ModTime)
+		}
+		mode := int64(0644)
+		if header.Name == "dir/b.txt" {
+			mode = 0750
+		}
+		if header.Mode != mode {
+			t.Errorf("Unexpected mode for %v: %o", header.Name, header.Mode)
+		}
+	}
+	if len(found) != len(files) {
+		t.Errorf("Expected %v files, found %v", len(files), len(found))
+	}
+	for name, content := range files {
+		if found[name] != content {
+			t.Errorf("Content mismatch for %v", name)
+		}
+	}
+
+	buf.Reset()
+	options := ExportOptions{Format: ZIP_FORMAT, Paths: []string{"dir/", "a.txt"}}
+	check(ExportState(backend, state, &buf, options))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	check(err)
+	var names []string
+	for _, file := range zr.File {
+		names = append(names, file.Name)
+		fd, err := file.Open()
+		check(err)
+		data, err := io.ReadAll(fd)
+		check(err)
+		if string(data) != files[file.Name] {
+			t.Errorf("Content mismatch for %v", file.Name)
+		}
+		if file.Name == "dir/b.txt" && file.Mode().Perm() != 0750 {
+			t.Errorf("Unexpected mode for %v: %v", file.Name, file.Mode())
+		}
+	}
+	expected := []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"}
+	if len(names) != len(expected) {
+		t.Fatalf("Unexpected files %v", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Unexpected files %v", names)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package enki
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Flush pending blocks once one of those limits is reached
+const (
+	httpBatchBlocks = 256
+	httpBatchSize   = 8 << 20
+)
+
+type pendingBlock struct {
+	strong *StrongHash
+	weak   WeakHash
+	data   Block
+}
+
+// HTTPBackend is a client for a BackendServer (see nk serve). Weak
+// hashes are searched in a local copy of the server bloom filter, and
+// new blocks are buffered so that a single request tells which ones
+// the server is missing before uploading them.
+type HTTPBackend struct {
+	url         string
+	client      *http.Client
+	bloom       *BloomFilter
+	weaks       map[WeakHash]bool
+	pending     []pendingBlock
+	pendingMap  map[StrongHash]Block
+	pendingSize int
+	// Answers of the server to existence checks (and blocks uploaded)
+	known map[StrongHash]bool
+}
+
+func NewHTTPBackend(url string) Backend {
+	backend := &HTTPBackend{
+		url:        strings.TrimRight(url, "/"),
+		client:     &http.Client{},
+		weaks:      make(map[WeakHash]bool),
+		pendingMap: make(map[StrongHash]Block),
+		known:      make(map[StrongHash]bool),
+	}
+	data := backend.request("GET", "/weaks", nil)
+	if data != nil {
+		bloom, err := LoadBloomFilter(data)
+		check(err)
+		backend.bloom = bloom
+	}
+	return backend
+}
+
+// Send a request and return the response body, nil if the resource
+// is not found
+func (self *HTTPBackend) request(method, route string, body []byte) []byte {
+	req, err := http.NewRequest(method, self.url+route, bytes.NewReader(body))
+	check(err)
+	resp, err := self.client.Do(req)
+	check(err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	check(err)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		panic(fmt.Sprintf("%v %v failed: %v %v", method, route, resp.Status,
+			strings.TrimSpace(string(data))))
+	}
+	return data
+}
+
+func (self *HTTPBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	if _, present := self.pendingMap[*strong]; present {
+		return
+	}
+	self.pending = append(self.pending, pendingBlock{strong, weak, data})
+	self.pendingMap[*strong] = data
+	self.pendingSize += len(data)
+	if self.bloom != nil {
+		self.bloom.Add(weak)
+	} else {
+		self.weaks[weak] = true
+	}
+	if len(self.pending) >= httpBatchBlocks || self.pendingSize >= httpBatchSize {
+		self.flush()
+	}
+}
+
+// Upload the pending blocks the server does not know yet
+func (self *HTTPBackend) flush() {
+	if len(self.pending) == 0 {
+		return
+	}
+	var hashes bytes.Buffer
+	for _, block := range self.pending {
+		hashes.Write(block.strong[:])
+	}
+	known := self.request("POST", "/blocks/has", hashes.Bytes())
+	if len(known) != len(self.pending) {
+		panic("Unexpected response length from server")
+	}
+
+	var body bytes.Buffer
+	for i, block := range self.pending {
+		if known[i] == 0 {
+			writeBlockRecord(&body, block.strong, block.weak, block.data)
+		}
+		self.known[*block.strong] = true
+	}
+	if body.Len() > 0 {
+		self.request("POST", "/blocks", body.Bytes())
+	}
+	self.pending = nil
+	self.pendingMap = make(map[StrongHash]Block)
+	self.pendingSize = 0
+}
+
+func (self *HTTPBackend) SearchWeak(weak WeakHash) bool {
+	if self.bloom != nil {
+		return self.bloom.Test(weak)
+	}
+	return self.weaks[weak]
+}
+
+func (self *HTTPBackend) ReadStrong(strong *StrongHash) Block {
+	if data, present := self.pendingMap[*strong]; present {
+		return data
+	}
+	return self.request("GET", "/blocks/"+hex.EncodeToString(strong[:]), nil)
+}
+
+// Check the existence of a block without downloading it
+func (self *HTTPBackend) HasBlock(strong *StrongHash) bool {
+	if _, present := self.pendingMap[*strong]; present {
+		return true
+	}
+	if known, ok := self.known[*strong]; ok {
+		return known
+	}
+	result := self.request("POST", "/blocks/has", strong[:])
+	if len(result) != 1 {
+		panic("Unexpected response length from server")
+	}
+	self.known[*strong] = result[0] == 1
+	return result[0] == 1
+}
+
+func (self *HTTPBackend) ReadSignature(checksum []byte) *Signature {
+	data := self.request("GET", "/signatures/"+hex.EncodeToString(checksum), nil)
+	if data == nil {
+		return nil
+	}
+	sgn := &Signature{}
+	check(sgn.GobDecode(data))
+	return sgn
+}
+
+func (self *HTTPBackend) WriteSignature(checksum []byte, sgn *Signature) {
+	// Blocks must reach the server before the signatures using them
+	self.flush()
+	data, err := sgn.GobEncode()
+	check(err)
+	self.request("PUT", "/signatures/"+hex.EncodeToString(checksum), data)
+}
+
+func (self *HTTPBackend) ReadState(timestamp int64) *DirState {
+	data := self.request("GET", fmt.Sprintf("/states/%v", timestamp), nil)
+	if data == nil {
+		return nil
+	}
+	state := &DirState{}
+	state.GobDecode(data)
+	return state
+}
+
+func (self *HTTPBackend) WriteState(state *DirState) {
+	self.flush()
+	self.request("PUT", "/states", state.GobEncode())
+}
+
+func (self *HTTPBackend) Close() {
+	self.flush()
+}
@@ -0,0 +1,240 @@
+package enki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Blocks are at most 64k, leave some room for other block sizes
+const maxRecordSize = 16 << 20
+
+// Upper bound of request bodies, block uploads are batched by 8MB but
+// states of large directories can be much bigger
+var maxBodySize int64 = 1 << 30
+
+// BackendServer exposes a backend over HTTP, see HTTPBackend for the
+// client side. Endpoints:
+//
+//	POST /blocks/has         batched existence check of strong hashes
+//	POST /blocks             upload of one or more blocks
+//	GET  /blocks/<hash>      block content
+//	GET  /signatures/<hash>  gob-encoded signature
+//	PUT  /signatures/<hash>
+//	GET  /states/<ts>        gob-encoded state (nearest earlier)
+//	PUT  /states
+//	GET  /weaks              bloom filter of weak hashes (if any),
+//	                         gzipped if the client accepts it
+type BackendServer struct {
+	backend Backend
+}
+
+func NewBackendServer(backend Backend) *BackendServer {
+	return &BackendServer{NewSyncBackend(backend)}
+}
+
+type httpError struct {
+	code    int
+	message string
+}
+
+func (self *BackendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Backends signal failures by panicking
+	defer func() {
+		if rec := recover(); rec != nil {
+			if e, ok := rec.(httpError); ok {
+				http.Error(w, e.message, e.code)
+			} else {
+				http.Error(w, fmt.Sprint(rec), http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "blocks/has" && r.Method == "POST":
+		self.hasBlocks(w, r)
+	case route == "blocks" && r.Method == "POST":
+		self.putBlocks(w, r)
+	case strings.HasPrefix(route, "blocks/") && r.Method == "GET":
+		block := self.backend.ReadStrong(parseStrong(route[len("blocks/"):]))
+		if block == nil {
+			panic(httpError{http.StatusNotFound, "Block not found"})
+		}
+		w.Write(block)
+	case strings.HasPrefix(route, "signatures/"):
+		self.signature(w, r, parseHex(route[len("signatures/"):]))
+	case route == "states" && r.Method == "PUT":
+		state := &DirState{}
+		state.GobDecode(readBody(w, r))
+		self.backend.WriteState(state)
+		if cp, ok := self.backend.(Checkpointer); ok {
+			cp.Checkpoint()
+		}
+	case strings.HasPrefix(route, "states/") && r.Method == "GET":
+		ts, err := strconv.ParseInt(route[len("states/"):], 10, 64)
+		if err != nil {
+			panic(httpError{http.StatusBadRequest, err.Error()})
+		}
+		state := self.backend.ReadState(ts)
+		if state == nil {
+			panic(httpError{http.StatusNotFound, "State not found"})
+		}
+		w.Write(state.GobEncode())
+	case route == "weaks" && r.Method == "GET":
+		self.weaks(w, r)
+	default:
+		panic(httpError{http.StatusNotFound, "Unknown endpoint"})
+	}
+}
+
+func (self *BackendServer) hasBlocks(w http.ResponseWriter, r *http.Request) {
+	body := readBody(w, r)
+	if len(body)%StrongHashSize != 0 {
+		panic(httpError{http.StatusBadRequest, "Invalid hash list"})
+	}
+	result := make([]byte, len(body)/StrongHashSize)
+	for i := range result {
+		strong := &StrongHash{}
+		copy(strong[:], body[i*StrongHashSize:])
+		if hasBlock(self.backend, strong) {
+			result[i] = 1
+		}
+	}
+	w.Write(result)
+}
+
+func (self *BackendServer) putBlocks(w http.ResponseWriter, r *http.Request) {
+	body := bytes.NewReader(readBody(w, r))
+	for body.Len() > 0 {
+		strong, weak, data, err := readBlockRecord(body)
+		if err != nil {
+			panic(httpError{http.StatusBadRequest, err.Error()})
+		}
+		if *GetStrongHash(data) != *strong {
+			panic(httpError{http.StatusBadRequest, "Block does not match its hash"})
+		}
+		self.backend.AddBlock(weak, strong, data)
+	}
+}
+
+func (self *BackendServer) signature(w http.ResponseWriter, r *http.Request, checksum []byte) {
+	switch r.Method {
+	case "GET":
+		sgn := self.backend.ReadSignature(checksum)
+		if sgn == nil {
+			panic(httpError{http.StatusNotFound, "Signature not found"})
+		}
+		data, err := sgn.GobEncode()
+		check(err)
+		w.Write(data)
+	case "PUT":
+		sgn := &Signature{}
+		err := sgn.GobDecode(readBody(w, r))
+		if err != nil {
+			panic(httpError{http.StatusBadRequest, err.Error()})
+		}
+		self.backend.WriteSignature(checksum, sgn)
+	default:
+		panic(httpError{http.StatusMethodNotAllowed, "Method not allowed"})
+	}
+}
+
+func (self *BackendServer) weaks(w http.ResponseWriter, r *http.Request) {
+	var filter []byte
+	if wf, ok := self.backend.(WeakFilterer); ok {
+		filter = wf.WeakFilter()
+	}
+	if filter == nil {
+		panic(httpError{http.StatusNotFound, "No weak filter"})
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !acceptGzip(r) {
+		w.Write(filter)
+		return
+	}
+	// Filters are mostly zeroes
+	w.Header().Set("Content-Encoding", "gzip")
+	zw := gzip.NewWriter(w)
+	zw.Write(filter)
+	zw.Close()
+}
+
+func acceptGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "gzip" || (strings.HasPrefix(encoding, "gzip;") && !strings.HasSuffix(encoding, "q=0")) {
+			return true
+		}
+	}
+	return false
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) []byte {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			panic(httpError{http.StatusRequestEntityTooLarge, err.Error()})
+		}
+		panic(httpError{http.StatusBadRequest, err.Error()})
+	}
+	return data
+}
+
+func parseHex(key string) []byte {
+	data, err := hex.DecodeString(key)
+	if err != nil {
+		panic(httpError{http.StatusBadRequest, err.Error()})
+	}
+	return data
+}
+
+func parseStrong(key string) *StrongHash {
+	data := parseHex(key)
+	if len(data) != StrongHashSize {
+		panic(httpError{http.StatusBadRequest, "Invalid hash"})
+	}
+	strong := &StrongHash{}
+	copy(strong[:], data)
+	return strong
+}
+
+// Block records are encoded as: strong hash, weak hash (4 bytes),
+// data size (4 bytes) and data.
+func writeBlockRecord(w io.Writer, strong *StrongHash, weak WeakHash, data Block) {
+	header := make([]byte, StrongHashSize+8)
+	copy(header, strong[:])
+	binary.LittleEndian.PutUint32(header[StrongHashSize:], uint32(weak))
+	binary.LittleEndian.PutUint32(header[StrongHashSize+4:], uint32(len(data)))
+	w.Write(header)
+	w.Write(data)
+}
+
+func readBlockRecord(r io.Reader) (*StrongHash, WeakHash, Block, error) {
+	header := make([]byte, StrongHashSize+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	strong := &StrongHash{}
+	copy(strong[:], header)
+	weak := WeakHash(binary.LittleEndian.Uint32(header[StrongHashSize:]))
+	size := binary.LittleEndian.Uint32(header[StrongHashSize+4:])
+	if size > maxRecordSize {
+		return nil, 0, nil, fmt.Errorf("Block record too large")
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return strong, weak, data, nil
+}
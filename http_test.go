@@ -0,0 +1,132 @@
+package enki
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	dotDir := path.Join(t.TempDir(), ".nk")
+	check(os.Mkdir(dotDir, 0750))
+	serverBackend := NewBoltBackend(dotDir)
+	defer serverBackend.Close()
+	server := httptest.NewServer(NewBackendServer(serverBackend))
+	defer server.Close()
+
+	root := t.TempDir()
+	for _, name := range []string{"small.data", "big-shifted.data"} {
+		data, err := os.ReadFile(path.Join(test_data, name))
+		check(err)
+		check(os.WriteFile(path.Join(root, name), data, 0644))
+	}
+	client := NewHTTPBackend(server.URL)
+	state := ScanDirState(root, client, nil, ScanOptions{Jobs: 2})
+	state.Snapshot()
+	client.Close()
+
+	// Blocks known by the server are not uploaded again
+	client = NewHTTPBackend(server.URL).(*HTTPBackend)
+	data, err := os.ReadFile(path.Join(root, "small.data"))
+	check(err)
+	weak, _, _ := GetWeakHash(data[:8*1024])
+	if !client.SearchWeak(weak) {
+		t.Errorf("Weak hash not found in server filter")
+	}
+	last := LastState(client)
+	if last == nil || !bytes.Equal(last.Checksum(), state.Checksum()) {
+		t.Fatalf("State not found on server")
+	}
+	for name, fst := range last.FileStates {
+		var buf bytes.Buffer
+		check((&Blob{client}).Restore(fst.SgnSum, &buf))
+		expected, err := os.ReadFile(path.Join(root, name))
+		check(err)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("Content mismatch for %v", name)
+		}
+	}
+	if client.ReadStrong(&StrongHash{}) != nil || client.ReadSignature([]byte{0}) != nil {
+		t.Errorf("Unknown keys should not be found")
+	}
+	client.Close()
+
+	// Known blocks are checked without being downloaded
+	counter := &requestCounter{handler: NewBackendServer(serverBackend)}
+	server.Config.Handler = counter
+	client = NewHTTPBackend(server.URL).(*HTTPBackend)
+	ScanDirState(root, client, nil, ScanOptions{Checksum: true}).Snapshot()
+	client.Close()
+	if counter.requests["GET /blocks"] != 0 || counter.requests["POST /blocks/has"] == 0 {
+		t.Errorf("Unexpected requests %v", counter.requests)
+	}
+}
+
+// Counts the requests by method and route (without the key)
+type requestCounter struct {
+	handler  http.Handler
+	requests map[string]int
+	mutex    sync.Mutex
+}
+
+func (self *requestCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Path
+	if r.Method == "GET" {
+		route = path.Dir(route)
+	}
+	self.mutex.Lock()
+	if self.requests == nil {
+		self.requests = make(map[string]int)
+	}
+	self.requests[r.Method+" "+route]++
+	self.mutex.Unlock()
+	self.handler.ServeHTTP(w, r)
+}
+
+func TestBackendServerRequests(t *testing.T) {
+	dotDir := path.Join(t.TempDir(), ".nk")
+	check(os.Mkdir(dotDir, 0750))
+	serverBackend := NewBoltBackend(dotDir)
+	defer serverBackend.Close()
+	server := httptest.NewServer(NewBackendServer(serverBackend))
+	defer server.Close()
+
+	// The weak filter is only gzipped for clients accepting it
+	transport := &http.Transport{DisableCompression: true}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	for _, encoding := range []string{"", "gzip"} {
+		req, err := http.NewRequest("GET", server.URL+"/weaks", nil)
+		check(err)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		resp, err := client.Do(req)
+		check(err)
+		data, err := io.ReadAll(resp.Body)
+		check(err)
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("Unexpected encoding %q", resp.Header.Get("Content-Encoding"))
+		}
+		if encoding == "" && !bytes.Equal(data, serverBackend.(WeakFilterer).WeakFilter()) {
+			t.Errorf("Weak filter mismatch")
+		}
+	}
+
+	// Request bodies are bounded
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 1024
+	resp, err := client.Post(server.URL+"/blocks/has", "application/octet-stream",
+		bytes.NewReader(make([]byte, 2048)))
+	check(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected status %v", resp.Status)
+	}
+}
@@ -0,0 +1,124 @@
+package enki
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshot the regular files of a tar archive (optionally gzipped) as
+// a new state with the given timestamp. Entries are chunked while the
+// archive is read, so it can be streamed.
+func ImportTar(backend Backend, r io.Reader, timestamp int64) (*DirState, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	state := &DirState{
+		Timestamp:  timestamp,
+		FileStates: make(map[string]FileState),
+		backend:    backend,
+	}
+	blob := NewBlob(backend)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			if header.Typeflag != tar.TypeDir {
+				log.Print("Skip ", header.Name)
+			}
+			continue
+		}
+
+		checksum := md5.New()
+		fst := FileState{
+			Timestamp: header.ModTime.Unix(),
+			ModTimeNs: header.ModTime.UnixNano(),
+			Size:      header.Size,
+			Mode:      os.FileMode(header.Mode).Perm(),
+			status:    NEW_FILE,
+		}
+		fst.Sgn = blob.Snapshot(io.TeeReader(tr, checksum), header.Size)
+		fst.SgnSum = checksum.Sum(nil)
+		backend.WriteSignature(fst.SgnSum, fst.Sgn)
+		log.Print("Add ", name)
+		state.FileStates[name] = fst
+	}
+	backend.WriteState(state)
+	return state, nil
+}
+
+// Returns the relative path of an archive entry, entries escaping the
+// archive root are refused
+func cleanEntryName(name string) (string, error) {
+	clean := strings.TrimLeft(path.Clean(name), "/")
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid archive entry '%v'", name)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+// Snapshot the content of r as a file called name. With keep, the
+// other files of the last state are kept in the new one, so restoring
+// it does not remove them from the working directory. Otherwise the
+// new state only holds that file.
+func ImportStream(backend Backend, r io.Reader, name string, timestamp int64, keep bool) (*DirState, error) {
+	name, err := cleanEntryName(filepath.ToSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	state := &DirState{
+		Timestamp:  timestamp,
+		FileStates: make(map[string]FileState),
+		backend:    backend,
+	}
+	if last := LastState(backend); keep && last != nil {
+		for relpath, fst := range last.FileStates {
+			state.FileStates[relpath] = fst
+		}
+	}
+
+	// The size is unknown, default block size is used
+	checksum := md5.New()
+	counter := &countWriter{}
+	sgn := NewBlob(backend).Snapshot(io.TeeReader(r, io.MultiWriter(checksum, counter)), 0)
+	fst := FileState{
+		Timestamp: timestamp,
+		ModTimeNs: timestamp * int64(time.Second),
+		Size:      counter.count,
+		SgnSum:    checksum.Sum(nil),
+		Sgn:       sgn,
+		status:    NEW_FILE,
+	}
+	backend.WriteSignature(fst.SgnSum, fst.Sgn)
+	state.FileStates[name] = fst
+	backend.WriteState(state)
+	return state, nil
+}
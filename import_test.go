@@ -0,0 +1,120 @@
+package enki
+
+import (
+	"archive/tar"
+	"bytes"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestImportTar(t *testing.T) {
+	root := t.TempDir()
+	mtime := time.Unix(1432808440, 0)
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		abspath := path.Join(root, name)
+		check(os.MkdirAll(path.Dir(abspath), 0750))
+		check(os.WriteFile(abspath, bytes.Repeat([]byte(name), 10000), 0644))
+		check(os.Chtimes(abspath, mtime, mtime))
+	}
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+
+	for _, format := range []int{TAR_FORMAT, TAR_GZ_FORMAT} {
+		var buf bytes.Buffer
+		check(ExportState(backend, state, &buf, ExportOptions{Format: format}))
+		other := NewMemoryBackend()
+		imported, err := ImportTar(other, &buf, 1432808454)
+		check(err)
+		if !bytes.Equal(imported.Checksum(), state.Checksum()) {
+			t.Errorf("Imported state differs")
+		}
+		last := LastState(other)
+		if last == nil || last.Timestamp != 1432808454 {
+			t.Fatalf("Imported state not found")
+		}
+		for name, fst := range last.FileStates {
+			if !fst.ModTime().Equal(mtime) {
+				t.Errorf("Unexpected mtime for %v", name)
+			}
+			var content bytes.Buffer
+			check(NewBlob(other).Restore(fst.SgnSum, &content))
+			expected, err := os.ReadFile(path.Join(root, name))
+			check(err)
+			if !bytes.Equal(content.Bytes(), expected) {
+				t.Errorf("Content mismatch for %v", name)
+			}
+		}
+	}
+
+	// Entries escaping the archive root are refused
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	check(tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg}))
+	check(tw.Close())
+	if _, err := ImportTar(NewMemoryBackend(), &buf, 1432808454); err == nil {
+		t.Errorf("Invalid entry accepted")
+	}
+}
+
+func TestImportStream(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.WriteState(&DirState{
+		Timestamp:  1432808440,
+		FileStates: map[string]FileState{"other.txt": {SgnSum: []byte("sum")}},
+	})
+	dump := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(dump)
+	state, err := ImportStream(backend, bytes.NewReader(dump), "db.sql", 1432808442, true)
+	check(err)
+	if len(state.FileStates) != 2 || state.FileStates["other.txt"].SgnSum == nil {
+		t.Errorf("Files of the previous state lost: %v", state.FileStates)
+	}
+
+	// Next dump only differs by a few bytes, and is stored alone
+	next := concat(dump[:1000000], []byte("-- changed"), dump[1000000:])
+	state, err = ImportStream(backend, bytes.NewReader(next), "db.sql", 1432808454, false)
+	check(err)
+	if _, ok := state.FileStates["db.sql"]; !ok || len(state.FileStates) != 1 {
+		t.Errorf("Unexpected files %v", state.FileStates)
+	}
+	fst := LastState(backend).FileStates["db.sql"]
+	if fst.Size != int64(len(next)) {
+		t.Errorf("Unexpected size %v", fst.Size)
+	}
+	var buf bytes.Buffer
+	check(NewBlob(backend).Restore(fst.SgnSum, &buf))
+	if !bytes.Equal(buf.Bytes(), next) {
+		t.Errorf("Content mismatch")
+	}
+	blocks := len(backend.(*MemoryBackend).BlockMap)
+	if blocks > len(dump)/(64*1024)+4 {
+		t.Errorf("Dumps not deduplicated (%v blocks)", blocks)
+	}
+}
+
+func TestImportStreamRestore(t *testing.T) {
+	root := t.TempDir()
+	check(os.WriteFile(path.Join(root, "other.txt"), []byte("other"), 0644))
+	backend := NewMemoryBackend()
+	prev := NewDirState(root, backend, nil)
+	prev.Snapshot()
+	_, err := ImportStream(backend, bytes.NewReader([]byte("dump")), "db.sql",
+		prev.Timestamp+1, true)
+	check(err)
+
+	// Restoring the last state keeps the files of the directory
+	current := NewDirState(root, backend, LastState(backend))
+	if errs := current.RestorePrev(); len(errs) != 0 {
+		t.Fatalf("Restore failed: %v", errs)
+	}
+	for name, expected := range map[string]string{"other.txt": "other", "db.sql": "dump"} {
+		content, err := os.ReadFile(path.Join(root, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("Unexpected content for %v: %q (%v)", name, content, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package enki
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	SHARED_LOCK    = iota
+	EXCLUSIVE_LOCK = iota
+)
+
+// Unreadable lock files older than this are considered stale, a lock
+// is written in one go so it can only be unreadable for a short time
+const staleLockTimeout = time.Minute
+
+// Lock files live in the locks sub-directory of the repository, one
+// per process. Readers take a shared lock, writers an exclusive one.
+type RepoLock struct {
+	Mode     int
+	Hostname string
+	Pid      int
+	Time     time.Time
+	path     string
+	corrupt  bool
+}
+
+func (self *RepoLock) String() string {
+	if self.corrupt {
+		return fmt.Sprintf("unreadable lock %v", self.path)
+	}
+	kind := "shared"
+	if self.Mode == EXCLUSIVE_LOCK {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%v lock %v held by pid %v on %v since %v", kind,
+		self.path, self.Pid, self.Hostname, self.Time.Format(time.RFC3339))
+}
+
+// A lock is stale if its process, running on this host, is gone
+func (self *RepoLock) Stale() bool {
+	if self.corrupt {
+		return time.Since(self.Time) > staleLockTimeout
+	}
+	hostname, _ := os.Hostname()
+	return self.Hostname == hostname && !processAlive(self.Pid)
+}
+
+func (self *RepoLock) conflicts(mode int) bool {
+	return mode == EXCLUSIVE_LOCK || self.Mode == EXCLUSIVE_LOCK
+}
+
+// Take a lock on the repository, waiting at most timeout for
+// conflicting locks to be released. Stale locks are removed on the
+// way.
+func LockRepo(dotDir string, mode int, timeout time.Duration) (*RepoLock, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	lock := &RepoLock{
+		Mode:     mode,
+		Hostname: hostname,
+		Pid:      os.Getpid(),
+		Time:     time.Now(),
+	}
+	lockDir := path.Join(dotDir, "locks")
+	lock.path = path.Join(lockDir, fmt.Sprintf("%v-%v", hostname, lock.Pid))
+	// Nobody can write on a read-only file system, readers can
+	// safely go without lock
+	readOnlyFS := func(err error) bool {
+		return mode == SHARED_LOCK && errors.Is(err, syscall.EROFS)
+	}
+	err = os.MkdirAll(lockDir, 0750)
+	if readOnlyFS(err) {
+		lock.path = ""
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// Write our own lock and then look for conflicts, so two
+		// processes starting at the same time both see each other
+		data, err := json.Marshal(lock)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(lock.path, data, 0640)
+		if readOnlyFS(err) {
+			lock.path = ""
+			return lock, nil
+		} else if err != nil {
+			return nil, err
+		}
+		holder, err := findConflict(lockDir, lock)
+		if err != nil || holder == nil {
+			return lock, err
+		}
+		os.Remove(lock.path)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Repository is locked (%v)", holder)
+		}
+		// Random backoff to break ties between competing writers
+		time.Sleep(100*time.Millisecond + time.Duration(rand.Int63n(int64(100*time.Millisecond))))
+	}
+}
+
+func findConflict(lockDir string, lock *RepoLock) (*RepoLock, error) {
+	locks, err := ListLocks(path.Dir(lockDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range locks {
+		if other.path == lock.path || !other.conflicts(lock.Mode) {
+			continue
+		}
+		if other.Stale() {
+			os.Remove(other.path)
+			continue
+		}
+		return other, nil
+	}
+	return nil, nil
+}
+
+func (self *RepoLock) Unlock() error {
+	if self.path == "" {
+		return nil
+	}
+	return os.Remove(self.path)
+}
+
+// Returns all the locks currently held on the repository
+func ListLocks(dotDir string) ([]*RepoLock, error) {
+	lockDir := path.Join(dotDir, "locks")
+	entries, err := os.ReadDir(lockDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var locks []*RepoLock
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		lock := &RepoLock{path: path.Join(lockDir, entry.Name())}
+		data, err := os.ReadFile(lock.path)
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if json.Unmarshal(data, lock) != nil {
+			// Half-written lock, consider it exclusive until it
+			// gets too old
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			lock = &RepoLock{
+				Mode:    EXCLUSIVE_LOCK,
+				Time:    info.ModTime(),
+				path:    lock.path,
+				corrupt: true,
+			}
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// Remove stale locks (or all of them if all is true) and return the
+// removed ones
+func RemoveLocks(dotDir string, all bool) ([]*RepoLock, error) {
+	locks, err := ListLocks(dotDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []*RepoLock
+	for _, lock := range locks {
+		if !all && !lock.Stale() {
+			continue
+		}
+		err = os.Remove(lock.path)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, lock)
+	}
+	return removed, nil
+}
@@ -0,0 +1,78 @@
+package enki
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepoLock(t *testing.T) {
+	dotDir := t.TempDir()
+	lock, err := LockRepo(dotDir, SHARED_LOCK, 0)
+	check(err)
+
+	// Fake a shared lock held by another live process
+	hostname, err := os.Hostname()
+	check(err)
+	other := &RepoLock{Mode: SHARED_LOCK, Hostname: hostname, Pid: os.Getppid()}
+	data, err := json.Marshal(other)
+	check(err)
+	check(os.WriteFile(path.Join(dotDir, "locks", "other"), data, 0640))
+
+	check(lock.Unlock())
+	lock, err = LockRepo(dotDir, SHARED_LOCK, 0)
+	if err != nil {
+		t.Errorf("Shared locks should not conflict: %v", err)
+	}
+	check(lock.Unlock())
+	_, err = LockRepo(dotDir, EXCLUSIVE_LOCK, 200*time.Millisecond)
+	if err == nil {
+		t.Errorf("Exclusive lock should conflict")
+	}
+
+	// Locks of dead processes are stale
+	other.Pid = 1 << 30
+	other.Mode = EXCLUSIVE_LOCK
+	data, err = json.Marshal(other)
+	check(err)
+	check(os.WriteFile(path.Join(dotDir, "locks", "other"), data, 0640))
+	lock, err = LockRepo(dotDir, SHARED_LOCK, 0)
+	if err != nil {
+		t.Errorf("Stale lock not removed: %v", err)
+	}
+	check(lock.Unlock())
+
+	locks, err := ListLocks(dotDir)
+	check(err)
+	if len(locks) != 0 {
+		t.Errorf("Unexpected locks: %v", locks)
+	}
+}
+
+func TestCorruptLock(t *testing.T) {
+	dotDir := t.TempDir()
+	lockPath := path.Join(dotDir, "locks", "corrupt")
+	check(os.MkdirAll(path.Dir(lockPath), 0750))
+	check(os.WriteFile(lockPath, []byte("{\"Mode\":"), 0640))
+
+	// A fresh unreadable lock is exclusive
+	_, err := LockRepo(dotDir, SHARED_LOCK, 0)
+	if err == nil || !strings.Contains(err.Error(), lockPath) {
+		t.Errorf("Lock file path not reported: %v", err)
+	}
+
+	// And stale once old enough
+	old := time.Now().Add(-2 * staleLockTimeout)
+	check(os.Chtimes(lockPath, old, old))
+	lock, err := LockRepo(dotDir, EXCLUSIVE_LOCK, 0)
+	if err != nil {
+		t.Errorf("Old unreadable lock not removed: %v", err)
+	}
+	check(lock.Unlock())
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("Unreadable lock still present")
+	}
+}
@@ -1,16 +1,20 @@
 package enki
 
+import (
+	"encoding/gob"
+	"os"
+)
+
 type MemoryBackend struct {
 	BlockMap     map[StrongHash]Block
 	WeakMap      map[WeakHash]bool
 	SignatureMap map[string]*Signature
 	StateMap     map[int64]*DirState
-	weakMap         map[WeakHash]bool
+	filePath     string
 }
 
 func NewMemoryBackend() Backend {
 	backend := &MemoryBackend{}
-	backend.weakMap = make(map[WeakHash]bool)
 	backend.BlockMap = make(map[StrongHash]Block)
 	backend.WeakMap = make(map[WeakHash]bool)
 	backend.SignatureMap = make(map[string]*Signature)
@@ -18,6 +22,56 @@ func NewMemoryBackend() Backend {
 	return backend
 }
 
+// Returns a memory backend loaded from filePath (if it exists), whose
+// content is saved back to filePath on Close.
+func OpenMemoryBackend(filePath string) Backend {
+	backend, err := LoadMemoryBackend(filePath)
+	if os.IsNotExist(err) {
+		backend = NewMemoryBackend().(*MemoryBackend)
+	} else {
+		check(err)
+	}
+	backend.filePath = filePath
+	return backend
+}
+
+// Returns the memory backend saved in filePath
+func LoadMemoryBackend(filePath string) (*MemoryBackend, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	backend := NewMemoryBackend().(*MemoryBackend)
+	err = gob.NewDecoder(fd).Decode(backend)
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// Write the whole content of the backend in filePath. The file is
+// replaced atomically, so a crash leaves the previous version intact.
+func (self *MemoryBackend) Save(filePath string) error {
+	tmpPath := filePath + ".tmp"
+	fd, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(fd).Encode(self)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
 func (self *MemoryBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
 	_, present := self.BlockMap[*strong]
 	if !present {
@@ -35,7 +89,7 @@ func (self *MemoryBackend) ReadStrong(strong *StrongHash) Block {
 }
 
 func (self *MemoryBackend) SearchWeak(weak WeakHash) bool {
-	return self.weakMap[weak]
+	return self.WeakMap[weak]
 }
 
 func (self *MemoryBackend) ReadSignature(checksum []byte) *Signature {
@@ -50,12 +104,16 @@ func (self *MemoryBackend) WriteSignature(checksum []byte, sgn *Signature) {
 	self.SignatureMap[string(checksum)] = sgn
 }
 
-func (self *MemoryBackend) ReadState(id int64) *DirState {
-	st, present := self.StateMap[id]
-	if !present {
-		return nil
+// Returns the state with the given timestamp, or the closest earlier
+// one
+func (self *MemoryBackend) ReadState(timestamp int64) *DirState {
+	var found *DirState
+	for ts, st := range self.StateMap {
+		if ts <= timestamp && (found == nil || ts > found.Timestamp) {
+			found = st
+		}
 	}
-	return st
+	return found
 }
 
 func (self *MemoryBackend) WriteState(st *DirState) {
@@ -63,5 +121,7 @@ func (self *MemoryBackend) WriteState(st *DirState) {
 }
 
 func (self *MemoryBackend) Close() {
-	// pass
+	if self.filePath != "" {
+		check(self.Save(self.filePath))
+	}
 }
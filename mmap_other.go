@@ -0,0 +1,24 @@
+//go:build !unix
+
+package enki
+
+import (
+	"io"
+	"os"
+)
+
+// Without mmap, the file is loaded in memory and written back when
+// unmapped.
+func mapFile(file *os.File, size int, writable bool) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(file, data)
+	return data, err
+}
+
+func unmapFile(file *os.File, data []byte, writable bool) error {
+	if !writable {
+		return nil
+	}
+	_, err := file.WriteAt(data, 0)
+	return err
+}
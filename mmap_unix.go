@@ -0,0 +1,20 @@
+//go:build unix
+
+package enki
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapFile(file *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(file.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+func unmapFile(file *os.File, data []byte, writable bool) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,252 @@
+package enki
+
+import (
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Name of the snapshot directories
+	mountTimeFormat = "2006-01-02T15:04:05"
+	// Number of snapshots kept in memory
+	mountCachedStates = 16
+)
+
+// FuseMount exposes the snapshots of a backend as a read-only FUSE
+// file system. Each snapshot is a directory named after its (local)
+// time, files are read lazily from the backend. The backend is only
+// acquired while serving requests and while files are open.
+type FuseMount struct {
+	mountpoint string
+	conn       *fuse.Conn
+	root       *mountRoot
+}
+
+func NewFuseMount(backend *SharedBackend, mountpoint string) (*FuseMount, error) {
+	conn, err := fuse.Mount(mountpoint, fuse.ReadOnly(), fuse.FSName("enki"),
+		fuse.Subtype("enki"))
+	if err != nil {
+		return nil, err
+	}
+	root := &mountRoot{
+		backend: backend,
+		states:  make(map[int64]*SnapshotFS),
+	}
+	return &FuseMount{mountpoint, conn, root}, nil
+}
+
+// Serve requests until the file system is unmounted
+func (self *FuseMount) Serve() error {
+	defer self.conn.Close()
+	return fusefs.Serve(self.conn, self)
+}
+
+func (self *FuseMount) Unmount() error {
+	return fuse.Unmount(self.mountpoint)
+}
+
+func (self *FuseMount) Root() (fusefs.Node, error) {
+	return self.root, nil
+}
+
+// Open the repository for the duration of a request
+func acquire(backend *SharedBackend) error {
+	if err := backend.Acquire(); err != nil {
+		log.Print("Can not open repository: ", err)
+		return syscall.EBUSY
+	}
+	return nil
+}
+
+// Top directory, holds one directory per snapshot
+type mountRoot struct {
+	backend *SharedBackend
+	states  map[int64]*SnapshotFS
+	mutex   sync.Mutex
+}
+
+func (self *mountRoot) Attr(ctx context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (self *mountRoot) snapshot(ts int64) (fsys *SnapshotFS, err error) {
+	defer recoverError(&err)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	fsys, ok := self.states[ts]
+	if ok {
+		return fsys, nil
+	}
+	if err := acquire(self.backend); err != nil {
+		return nil, err
+	}
+	defer self.backend.Release()
+	state := self.backend.ReadState(ts)
+	if state == nil || state.Timestamp != ts {
+		return nil, syscall.ENOENT
+	}
+	fsys = NewSnapshotFS(self.backend, state)
+	if len(self.states) >= mountCachedStates {
+		self.states = make(map[int64]*SnapshotFS)
+	}
+	self.states[ts] = fsys
+	return fsys, nil
+}
+
+func (self *mountRoot) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	ts, err := time.ParseInLocation(mountTimeFormat, name, time.Local)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	fsys, err := self.snapshot(ts.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return &mountDir{self.backend, fsys, "."}, nil
+}
+
+func (self *mountRoot) ReadDirAll(ctx context.Context) (entries []fuse.Dirent, err error) {
+	if err := acquire(self.backend); err != nil {
+		return nil, err
+	}
+	defer self.backend.Release()
+	defer recoverError(&err)
+	// States are listed on each call, so new snapshots show up
+	state := LastState(self.backend)
+	for state != nil {
+		name := time.Unix(state.Timestamp, 0).Format(mountTimeFormat)
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+		state = self.backend.ReadState(state.Timestamp - 1)
+	}
+	// Oldest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// Directory of a snapshot, "." being its root
+type mountDir struct {
+	backend *SharedBackend
+	fsys    *SnapshotFS
+	name    string
+}
+
+func (self *mountDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	info, err := self.fsys.Stat(self.name)
+	if err != nil {
+		return err
+	}
+	attr.Mode = info.Mode()
+	attr.Mtime = info.ModTime()
+	return nil
+}
+
+func (self *mountDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	relpath := path.Join(self.name, name)
+	info, err := self.fsys.Stat(relpath)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	if info.IsDir() {
+		return &mountDir{self.backend, self.fsys, relpath}, nil
+	}
+	return &mountFile{self.backend, self.fsys, relpath}, nil
+}
+
+func (self *mountDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	children, err := self.fsys.ReadDir(self.name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for _, child := range children {
+		entry := fuse.Dirent{Name: child.Name(), Type: fuse.DT_File}
+		if child.IsDir() {
+			entry.Type = fuse.DT_Dir
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type mountFile struct {
+	backend *SharedBackend
+	fsys    *SnapshotFS
+	name    string
+}
+
+func (self *mountFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	info, err := self.fsys.Stat(self.name)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// Files recorded before sizes were have to be opened to know
+		// their size
+		if err := acquire(self.backend); err != nil {
+			return err
+		}
+		defer self.backend.Release()
+		fd, err := self.fsys.Open(self.name)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		info, err = fd.Stat()
+		if err != nil {
+			return err
+		}
+	}
+	attr.Mode = info.Mode()
+	attr.Size = uint64(info.Size())
+	attr.Mtime = info.ModTime()
+	return nil
+}
+
+func (self *mountFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, syscall.EROFS
+	}
+	// The backend is released when the file is closed
+	if err := acquire(self.backend); err != nil {
+		return nil, err
+	}
+	fd, err := self.fsys.Open(self.name)
+	if err != nil {
+		self.backend.Release()
+		return nil, err
+	}
+	resp.Flags |= fuse.OpenKeepCache
+	return &mountHandle{self.backend, fd}, nil
+}
+
+type mountHandle struct {
+	backend *SharedBackend
+	fd      fs.File
+}
+
+func (self *mountHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := self.fd.(io.ReaderAt).ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (self *mountHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	defer self.backend.Release()
+	return self.fd.Close()
+}
@@ -0,0 +1,186 @@
+package enki
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func mountTestState(t *testing.T) (Backend, *DirState, []byte) {
+	root := t.TempDir()
+	big := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(big)
+	check(os.MkdirAll(path.Join(root, "dir"), 0750))
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("first file"), 0644))
+	check(os.WriteFile(path.Join(root, "dir", "big.data"), big, 0644))
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	return backend, state, big
+}
+
+// Counts the signatures read from the backend
+type sgnCountingBackend struct {
+	Backend
+	reads int
+}
+
+func (self *sgnCountingBackend) ReadSignature(checksum []byte) *Signature {
+	self.reads += 1
+	return self.Backend.ReadSignature(checksum)
+}
+
+func TestFuseNodes(t *testing.T) {
+	memBackend, state, big := mountTestState(t)
+	backend := &sgnCountingBackend{Backend: memBackend}
+	root := &mountRoot{backend: sharedBackend(backend), states: make(map[int64]*SnapshotFS)}
+	ctx := context.Background()
+
+	entries, err := root.ReadDirAll(ctx)
+	check(err)
+	name := time.Unix(state.Timestamp, 0).Format(mountTimeFormat)
+	if len(entries) != 1 || entries[0].Name != name {
+		t.Fatalf("Unexpected snapshots %v", entries)
+	}
+	if _, err := root.Lookup(ctx, "2000-01-01T00:00:00"); err == nil {
+		t.Errorf("Lookup of a missing snapshot should fail")
+	}
+	snap, err := root.Lookup(ctx, name)
+	check(err)
+	dir, err := snap.(*mountDir).Lookup(ctx, "dir")
+	check(err)
+	entries, err = dir.(*mountDir).ReadDirAll(ctx)
+	check(err)
+	if len(entries) != 1 || entries[0].Name != "big.data" || entries[0].Type != fuse.DT_File {
+		t.Errorf("Unexpected listing %v", entries)
+	}
+
+	node, err := dir.(*mountDir).Lookup(ctx, "big.data")
+	check(err)
+	file := node.(*mountFile)
+	var attr fuse.Attr
+	check(file.Attr(ctx, &attr))
+	fst := state.FileStates["dir/big.data"]
+	if attr.Size != uint64(len(big)) || !attr.Mtime.Equal(fst.ModTime()) {
+		t.Errorf("Unexpected attributes %v", attr)
+	}
+	if backend.reads != 0 {
+		t.Errorf("Attributes read %v signatures", backend.reads)
+	}
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	check(err)
+	resp := &fuse.ReadResponse{}
+	check(handle.(*mountHandle).Read(ctx, &fuse.ReadRequest{Offset: 299000, Size: 4096}, resp))
+	if !bytes.Equal(resp.Data, big[299000:]) {
+		t.Errorf("Unexpected content (%v bytes)", len(resp.Data))
+	}
+	if _, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{}); err == nil {
+		t.Errorf("Open for writing should fail")
+	}
+
+	// Snapshots kept in memory are bounded
+	root.states = make(map[int64]*SnapshotFS)
+	for ts := int64(0); ts < mountCachedStates; ts++ {
+		root.states[ts] = &SnapshotFS{}
+	}
+	_, err = root.Lookup(ctx, name)
+	check(err)
+	if len(root.states) > mountCachedStates {
+		t.Errorf("Unexpected number of cached snapshots: %v", len(root.states))
+	}
+}
+
+func TestFuseRepo(t *testing.T) {
+	root := t.TempDir()
+	dotDir := t.TempDir()
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("first"), 0644))
+	backend := NewBoltBackend(dotDir)
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	backend.Close()
+	mount := &mountRoot{backend: sharedRepo(dotDir), states: make(map[int64]*SnapshotFS)}
+	ctx := context.Background()
+	locks := func() int {
+		locks, err := ListLocks(dotDir)
+		check(err)
+		return len(locks)
+	}
+
+	entries, err := mount.ReadDirAll(ctx)
+	check(err)
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected snapshots %v", entries)
+	}
+	// The repository is locked while a file is open, and only then
+	snap, err := mount.Lookup(ctx, entries[0].Name)
+	check(err)
+	node, err := snap.(*mountDir).Lookup(ctx, "a.txt")
+	check(err)
+	handle, err := node.(*mountFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	check(err)
+	if locks() != 1 {
+		t.Errorf("Repository not locked while a file is open")
+	}
+	check(handle.(*mountHandle).Release(ctx, &fuse.ReleaseRequest{}))
+	if locks() != 0 {
+		t.Fatalf("Repository locked while not in use")
+	}
+
+	// Snapshots taken while mounted show up
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("second"), 0644))
+	backend = NewBoltBackend(dotDir)
+	state = NewDirState(root, backend, nil)
+	state.Timestamp += 1
+	state.Snapshot()
+	backend.Close()
+	entries, err = mount.ReadDirAll(ctx)
+	check(err)
+	if len(entries) != 2 {
+		t.Errorf("New snapshot not listed: %v", entries)
+	}
+}
+
+func TestFuseMount(t *testing.T) {
+	if fd, err := os.Open("/dev/fuse"); err != nil {
+		t.Skip("FUSE not available: ", err)
+	} else {
+		fd.Close()
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount not available")
+	}
+	backend, state, big := mountTestState(t)
+	mountpoint := t.TempDir()
+	mount, err := NewFuseMount(sharedBackend(backend), mountpoint)
+	check(err)
+	done := make(chan error)
+	go func() { done <- mount.Serve() }()
+	defer func() {
+		check(mount.Unmount())
+		check(<-done)
+	}()
+
+	// Files are accessed from other processes: opening them here
+	// would deadlock with the server on the runtime poller
+	name := time.Unix(state.Timestamp, 0).Format(mountTimeFormat)
+	content, err := exec.Command("cat", path.Join(mountpoint, name, "dir", "big.data")).Output()
+	check(err)
+	if !bytes.Equal(content, big) {
+		t.Errorf("Unexpected content")
+	}
+	info, err := os.Stat(path.Join(mountpoint, name, "a.txt"))
+	check(err)
+	if info.Size() != int64(len("first file")) {
+		t.Errorf("Unexpected size %v", info.Size())
+	}
+	err = exec.Command("sh", "-c", "echo changed > "+path.Join(mountpoint, name, "a.txt")).Run()
+	if err == nil {
+		t.Errorf("Write should fail on a read-only mount")
+	}
+}
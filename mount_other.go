@@ -0,0 +1,22 @@
+//go:build !linux
+
+package enki
+
+import (
+	"errors"
+)
+
+// FuseMount is only available on Linux
+type FuseMount struct{}
+
+func NewFuseMount(backend *SharedBackend, mountpoint string) (*FuseMount, error) {
+	return nil, errors.New("FUSE mounts are only supported on Linux")
+}
+
+func (self *FuseMount) Serve() error {
+	return nil
+}
+
+func (self *FuseMount) Unmount() error {
+	return nil
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"bitbucket.org/bertrandchenal/enki"
 	"github.com/codegangsta/cli"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"runtime"
 	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -27,8 +35,8 @@ const (
 )
 
 
-func getBackend(c *cli.Context) enki.Backend {
-	dotDir := path.Join(c.GlobalString("root"), dotEnki)
+func getDotDir(c *cli.Context, root string, create bool) string {
+	dotDir := path.Join(root, dotEnki)
 	info, err := os.Stat(dotDir)
 
 	if err == nil {
@@ -36,6 +44,9 @@ func getBackend(c *cli.Context) enki.Backend {
 			log.Print("Abort, unexpected file ", dotDir)
 			os.Exit(1)
 		}
+	} else if os.IsNotExist(err) && !create {
+		log.Print("Abort, no repository found in ", root)
+		os.Exit(1)
 	} else if os.IsNotExist(err) {
 		if !c.GlobalBool("dry-run") {
 			os.Mkdir(dotDir, 0750)
@@ -44,12 +55,147 @@ func getBackend(c *cli.Context) enki.Backend {
 	} else {
 		panic(err)
 	}
+	return dotDir
+}
+
+// Lock the repository and open its backend, a shared lock gives a
+// read-only backend. The caller must close the backend before
+// releasing the lock.
+func getBackend(c *cli.Context, mode int) (enki.Backend, *enki.RepoLock) {
+	root := c.GlobalString("root")
+	if remote := c.GlobalString("remote"); remote != "" {
+		root = remote
+	}
+	return openBackend(c, root, mode, mode == enki.EXCLUSIVE_LOCK)
+}
+
+func isRemote(root string) bool {
+	return strings.HasPrefix(root, "http://") || strings.HasPrefix(root, "https://")
+}
+
+// Open a repository stored in s3://bucket/prefix. The endpoint and
+// credentials are read from the environment, indexes are cached in the
+// user cache directory.
+func openS3Backend(root string) enki.Backend {
+	bucket := strings.TrimPrefix(root, "s3://")
+	prefix := ""
+	if pos := strings.Index(bucket, "/"); pos >= 0 {
+		bucket, prefix = bucket[:pos], bucket[pos+1:]
+	}
+	region := os.Getenv("AWS_REGION")
+	endpoint := os.Getenv("NK_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+		if region != "" {
+			endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", region)
+		}
+	}
+	client := enki.NewS3Client(endpoint, bucket, region,
+		os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
 
-	return enki.NewBoltBackend(dotDir)
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	key := md5.Sum([]byte(endpoint + "/" + root))
+	cacheDir = path.Join(cacheDir, "nk", hex.EncodeToString(key[:]))
+	return enki.NewS3Backend(client, prefix, cacheDir)
+}
+
+// Open the repository found in root, which can also be the url of a
+// remote repository (locking is then handled by the server)
+func openBackend(c *cli.Context, root string, mode int, create bool) (enki.Backend, *enki.RepoLock) {
+	if isRemote(root) {
+		return enki.NewHTTPBackend(root), &enki.RepoLock{}
+	}
+	if strings.HasPrefix(root, "s3://") {
+		// Packs are immutable, writers never conflict
+		return openS3Backend(root), &enki.RepoLock{}
+	}
+	if strings.HasPrefix(root, "sqlite://") {
+		// SQLite takes care of its own locking
+		dbPath := strings.TrimPrefix(root, "sqlite://")
+		if mode == enki.SHARED_LOCK {
+			return enki.NewReadOnlySQLiteBackend(dbPath), &enki.RepoLock{}
+		}
+		return enki.NewSQLiteBackend(dbPath), &enki.RepoLock{}
+	}
+	dotDir := getDotDir(c, root, create)
+	lock, err := enki.LockRepo(dotDir, mode, c.GlobalDuration("lock-wait"))
+	if err != nil {
+		log.Print("Abort, ", err)
+		os.Exit(1)
+	}
+	if mode == enki.SHARED_LOCK {
+		return enki.NewReadOnlyBoltBackend(dotDir), lock
+	}
+	return enki.NewBoltBackend(dotDir), lock
+}
+
+// Backend closed along with what it depends on
+type closingBackend struct {
+	enki.Backend
+	close func()
+}
+
+func (self *closingBackend) Close() {
+	self.close()
+}
+
+// Open the repository for long running readers (browse, mount). Local
+// repositories are only locked and opened while serving requests, so
+// that snapshots can be taken meanwhile, other ones are opened once.
+// The returned function closes what is kept open.
+func getSharedBackend(c *cli.Context) (*enki.SharedBackend, func()) {
+	root := c.GlobalString("root")
+	if remote := c.GlobalString("remote"); remote != "" {
+		root = remote
+	}
+	if isRemote(root) || strings.HasPrefix(root, "s3://") ||
+		strings.HasPrefix(root, "sqlite://") {
+		backend, lock := openBackend(c, root, enki.SHARED_LOCK, false)
+		kept := &closingBackend{backend, func() {}}
+		open := func() (enki.Backend, error) {
+			return kept, nil
+		}
+		return enki.NewSharedBackend(open), func() {
+			backend.Close()
+			lock.Unlock()
+		}
+	}
+
+	dotDir := getDotDir(c, root, false)
+	wait := c.GlobalDuration("lock-wait")
+	open := func() (backend enki.Backend, err error) {
+		lock, err := enki.LockRepo(dotDir, enki.SHARED_LOCK, wait)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			// Opening failed
+			if backend == nil {
+				lock.Unlock()
+			}
+		}()
+		bolt := enki.NewReadOnlyBoltBackend(dotDir)
+		return &closingBackend{bolt, func() {
+			bolt.Close()
+			lock.Unlock()
+		}}, nil
+	}
+	return enki.NewSharedBackend(open), func() {}
+}
+
+func getScanOptions(c *cli.Context) enki.ScanOptions {
+	return enki.ScanOptions{
+		Checksum: c.GlobalBool("checksum"),
+		Jobs:     c.GlobalInt("jobs"),
+	}
 }
 
 func showLogs(c *cli.Context) {
-	backend := getBackend(c)
+	backend, lock := getBackend(c, enki.SHARED_LOCK)
+	defer lock.Unlock()
 	defer backend.Close()
 	lastState := enki.LastState(backend)
 	for lastState != nil {
@@ -64,10 +210,13 @@ func showStatus(c *cli.Context) {
 	var names []string
 
 	root := c.GlobalString("root")
-	backend := getBackend(c)
+	backend, lock := getBackend(c, enki.SHARED_LOCK)
+	defer lock.Unlock()
 	defer backend.Close()
 
-	currentState := enki.NewDirState(root, backend, nil)
+	options := getScanOptions(c)
+	options.HashOnly = true
+	currentState := enki.ScanDirState(root, backend, nil, options)
 
 	for name, _ := range currentState.FileStates {
 		names = append(names, name)
@@ -94,50 +243,472 @@ func showStatus(c *cli.Context) {
 	}
 }
 
-func restoreSnapshot(c *cli.Context) {
-	var prevState *enki.DirState
+// Interpret a user-given date, at any precision between the year and
+// the second
+func parseTime(user_time string) (time.Time, error) {
 	var err error
 	var ts time.Time
 	READ_TIME := [...]string{FULL_FMT, YEAR_FMT, MONTH_FMT, DAY_FMT, HOUR_FMT,
 		MIN_FMT}
+	loc, _ := time.LoadLocation("Local")
+	for _, format := range READ_TIME {
+		ts, err = time.ParseInLocation(format, user_time, loc)
+		if err == nil {
+			break
+		}
+	}
+	return ts, err
+}
+
+// Returns the state matching the first argument of the command (the
+// last state if none is given), nil if not found
+func readArgState(c *cli.Context, backend enki.Backend) *enki.DirState {
+	if len(c.Args()) == 0 {
+		state := enki.LastState(backend)
+		if state == nil {
+			fmt.Println("No snapshot found")
+		}
+		return state
+	}
+	user_time := c.Args()[0]
+	ts, err := parseTime(user_time)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	state := backend.ReadState(ts.Unix())
+	if state == nil {
+		fmt.Printf("No snapshot found for '%v'\n", user_time)
+	}
+	return state
+}
 
-	backend := getBackend(c)
+func restoreSnapshot(c *cli.Context) {
+	var prevState *enki.DirState
+
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	defer lock.Unlock()
 	defer backend.Close()
 
 	if len(c.Args()) > 0 {
-		user_time := c.Args()[0]
-		loc, _ := time.LoadLocation("Local")
-		// Try to interpret the given string
-		for _, format := range READ_TIME {
-			ts, err = time.ParseInLocation(format, user_time, loc)
-			if err == nil {
-				break
+		prevState = readArgState(c, backend)
+		if prevState == nil {
+			return
+		}
+	}
+
+	root := c.GlobalString("root")
+	currentState := enki.ScanDirState(root, backend, prevState, getScanOptions(c))
+	errs := currentState.RestorePrev()
+	if len(errs) > 0 {
+		log.Printf("%v file(s) could not be restored", len(errs))
+		backend.Close()
+		lock.Unlock()
+		os.Exit(1)
+	}
+}
+
+func exportSnapshot(c *cli.Context) error {
+	output := c.String("output")
+	formatName := c.String("format")
+	if formatName == "" {
+		// Guess format from file name
+		formatName = "tar"
+		for _, ext := range []string{"tar.gz", "tgz", "zip"} {
+			if strings.HasSuffix(output, "."+ext) {
+				formatName = ext
 			}
 		}
+	}
+	format, err := enki.ParseArchiveFormat(formatName)
+	if err != nil {
+		return err
+	}
+
+	backend, lock := getBackend(c, enki.SHARED_LOCK)
+	defer lock.Unlock()
+	defer backend.Close()
+	state := readArgState(c, backend)
+	if state == nil {
+		return fmt.Errorf("snapshot not found")
+	}
+
+	fd, err := createOutput(output)
+	if err != nil {
+		return err
+	}
+	options := enki.ExportOptions{Format: format, Paths: c.StringSlice("path")}
+	return fd.finish(enki.ExportState(backend, state, fd, options))
+}
+
+// Returns the file named by the nth argument, stdin if missing or "-"
+func openArg(c *cli.Context, n int) (*os.File, error) {
+	name := c.Args().Get(n)
+	if name == "" || name == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(name)
+}
+
+// Output file, written next to its final name and only renamed in
+// place on success
+type outputFile struct {
+	*os.File
+	name string
+}
+
+// Creates the output file name, stdout if empty or "-"
+func createOutput(name string) (*outputFile, error) {
+	if name == "" || name == "-" {
+		return &outputFile{File: os.Stdout}, nil
+	}
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{fd, name}, nil
+}
+
+// Close the output, it replaces the named file if err is nil and is
+// removed otherwise
+func (self *outputFile) finish(err error) error {
+	if self.name == "" {
+		return err
+	}
+	if closeErr := self.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		return os.Rename(self.File.Name(), self.name)
+	}
+	os.Remove(self.File.Name())
+	return err
+}
+
+// Returns a command action exiting with a non-zero status when fn
+// fails
+func exitOnError(fn func(c *cli.Context) error) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		if err := fn(c); err != nil {
+			log.Print("Abort, ", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func rdiffSignature(c *cli.Context) error {
+	options := enki.RdiffOptions{
+		BlockLen:  c.Int("block-size"),
+		StrongLen: c.Int("sum-size"),
+	}
+	switch c.String("hash") {
+	case "blake2":
+		options.Magic = enki.RDIFF_BLAKE2_SIG_MAGIC
+	case "md4":
+		options.Magic = enki.RDIFF_MD4_SIG_MAGIC
+	default:
+		return fmt.Errorf("unknown hash %v", c.String("hash"))
+	}
+	basis, err := openArg(c, 0)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	sig, err := createOutput(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	return sig.finish(enki.RdiffSignature(basis, sig, options))
+}
+
+func rdiffDelta(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		return fmt.Errorf("signature expected")
+	}
+	sig, err := os.Open(c.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+	newFile, err := openArg(c, 1)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+	delta, err := createOutput(c.Args().Get(2))
+	if err != nil {
+		return err
+	}
+	return delta.finish(enki.RdiffDelta(sig, newFile, delta))
+}
+
+func rdiffPatch(c *cli.Context) error {
+	if len(c.Args()) < 1 {
+		return fmt.Errorf("basis expected")
+	}
+	basis, err := os.Open(c.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	delta, err := openArg(c, 1)
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+	newFile, err := createOutput(c.Args().Get(2))
+	if err != nil {
+		return err
+	}
+	return newFile.finish(enki.RdiffPatch(basis, delta, newFile))
+}
+
+func importArchive(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("archive expected (- for stdin)")
+	}
+	timestamp := time.Now().Unix()
+	if at := c.String("at"); at != "" {
+		ts, err := parseTime(at)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
+		timestamp = ts.Unix()
+	}
 
-		prevState = backend.ReadState(ts.Unix())
-		if prevState == nil {
-			fmt.Printf("No snapshot found for '%v'\n", user_time)
-			return
+	fd := os.Stdin
+	if name := c.Args()[0]; name != "-" {
+		var err error
+		fd, err = os.Open(name)
+		if err != nil {
+			return err
 		}
+		defer fd.Close()
 	}
 
-	root := c.GlobalString("root")
-	currentState := enki.NewDirState(root, backend, prevState)
-	currentState.RestorePrev()
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	defer lock.Unlock()
+	defer backend.Close()
+	// On error no state is written, blocks already stored are kept
+	_, err := enki.ImportTar(backend, fd, timestamp)
+	return err
 }
 
-func createSnapshot(c *cli.Context) {
+func createSnapshot(c *cli.Context) error {
+	if c.Bool("stdin") && c.String("name") == "" {
+		return fmt.Errorf("--name is required with --stdin")
+	}
 	root := c.GlobalString("root")
-	backend := getBackend(c)
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	defer lock.Unlock()
 	defer backend.Close()
 
-	currentState := enki.NewDirState(root, backend, nil)
+	if c.Bool("stdin") {
+		_, err := enki.ImportStream(backend, os.Stdin, c.String("name"), time.Now().Unix(),
+			!c.Bool("alone"))
+		return err
+	}
+
+	currentState := enki.ScanDirState(root, backend, nil, getScanOptions(c))
 	currentState.Snapshot()
+	return nil
+}
+
+func rebuildBloom(c *cli.Context) {
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	defer lock.Unlock()
+	defer backend.Close()
+
+	fpRate := c.Float64("fp-rate")
+	if fpRate < 0 || fpRate >= 1 {
+		log.Print("Abort, false positive rate must be between 0 and 1")
+		return
+	}
+	boltBackend, ok := backend.(*enki.BoltBackend)
+	if !ok {
+		log.Print("Abort, only local repositories have a bloom filter")
+		return
+	}
+	boltBackend.RebuildBloom(uint64(c.Int("capacity")), fpRate)
+}
+
+func unlockRepo(c *cli.Context) {
+	removed, err := enki.RemoveLocks(getDotDir(c, c.GlobalString("root"), false), c.Bool("all"))
+	for _, lock := range removed {
+		log.Print("Removed ", lock)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// Copy the missing states from srcRoot to dstRoot, the backends are
+// closed and unlocked before returning
+func replicate(c *cli.Context, srcRoot, dstRoot string, create bool) error {
+	src, srcLock := openBackend(c, srcRoot, enki.SHARED_LOCK, false)
+	defer srcLock.Unlock()
+	defer src.Close()
+	dst, dstLock := openBackend(c, dstRoot, enki.EXCLUSIVE_LOCK, create)
+	defer dstLock.Unlock()
+	defer dst.Close()
+
+	stats, err := enki.Replicate(src, dst)
+	log.Printf("Copied %v state(s), %v signature(s) and %v block(s)",
+		stats.States, stats.Signatures, stats.Blocks)
+	return err
+}
+
+func pushRepo(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Print("Abort, destination repository expected")
+		os.Exit(1)
+	}
+	if err := replicate(c, c.GlobalString("root"), c.Args()[0], false); err != nil {
+		log.Print("Abort, ", err)
+		os.Exit(1)
+	}
+}
+
+func pullRepo(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Print("Abort, source repository expected")
+		os.Exit(1)
+	}
+	if err := replicate(c, c.Args()[0], c.GlobalString("root"), false); err != nil {
+		log.Print("Abort, ", err)
+		os.Exit(1)
+	}
+}
+
+func cloneRepo(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Print("Abort, source repository expected")
+		os.Exit(1)
+	}
+	root := c.GlobalString("root")
+	if _, err := os.Stat(path.Join(root, dotEnki)); err == nil {
+		log.Print("Abort, a repository already exists in ", root)
+		os.Exit(1)
+	}
+	if err := replicate(c, c.Args()[0], root, true); err != nil {
+		log.Print("Abort, ", err)
+		os.Exit(1)
+	}
+}
+
+func createBundle(c *cli.Context) error {
+	var since int64
+	if user_time := c.String("since"); user_time != "" {
+		ts, err := parseTime(user_time)
+		if err != nil {
+			return err
+		}
+		since = ts.Unix()
+	}
+	backend, lock := getBackend(c, enki.SHARED_LOCK)
+	defer lock.Unlock()
+	defer backend.Close()
+
+	fd, err := createOutput(c.String("output"))
+	if err != nil {
+		return err
+	}
+	stats, err := enki.WriteBundle(backend, since, fd)
+	if err = fd.finish(err); err != nil {
+		return err
+	}
+	log.Printf("Bundled %v state(s), %v signature(s) and %v block(s)",
+		stats.States, stats.Signatures, stats.Blocks)
+	return nil
+}
+
+func applyBundle(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return fmt.Errorf("bundle expected")
+	}
+	bundle, err := enki.OpenBundle(c.Args()[0])
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	defer lock.Unlock()
+	defer backend.Close()
+
+	stats, err := enki.ApplyBundle(bundle, backend)
+	if err == nil || stats != (enki.ReplicateStats{}) {
+		log.Printf("Copied %v state(s), %v signature(s) and %v block(s)",
+			stats.States, stats.Signatures, stats.Blocks)
+	}
+	return err
+}
+
+func serveRepo(c *cli.Context) {
+	backend, lock := getBackend(c, enki.EXCLUSIVE_LOCK)
+	runServer(&http.Server{
+		Addr:    c.String("listen"),
+		Handler: enki.NewBackendServer(backend),
+	})
+	backend.Close()
+	lock.Unlock()
+}
+
+func browseRepo(c *cli.Context) {
+	backend, release := getSharedBackend(c)
+	runServer(&http.Server{
+		Addr:    c.String("listen"),
+		Handler: enki.NewWebServer(backend),
+	})
+	release()
+}
+
+func mountRepo(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Print("Abort, mount point expected")
+		return
+	}
+	backend, release := getSharedBackend(c)
+	defer release()
+	mount, err := enki.NewFuseMount(backend, c.Args()[0])
+	if err != nil {
+		log.Print("Abort, ", err)
+		return
+	}
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+		if err := mount.Unmount(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Print("Snapshots mounted on ", c.Args()[0])
+	if err := mount.Serve(); err != nil {
+		log.Print(err)
+	}
+}
+
+// Serve until interrupted, so that the caller can commit and release
+// the repository
+func runServer(server *http.Server) {
+	done := make(chan bool)
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+		server.Shutdown(context.Background())
+		close(done)
+	}()
+
+	log.Print("Listening on ", server.Addr)
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Print(err)
+	} else {
+		<-done
+	}
 }
 
 func initRepo(c *cli.Context) {
@@ -149,6 +720,71 @@ func main() {
 	app.Usage = "data versionning"
 	app.EnableBashCompletion = true
 	app.Commands = []cli.Command{
+		{
+			Name: "bundle",
+			Usage: "Move snapshots between repositories through a file",
+			Subcommands: []cli.Command{
+				{
+					Name: "create",
+					Usage: "Write the snapshots taken since a base snapshot in a bundle",
+					Flags: []cli.Flag {
+						cli.StringFlag{
+							Name: "since, s",
+							Usage: "Base snapshot, that the target repository must hold (default: none, bundle everything)",
+						},
+						cli.StringFlag{
+							Name: "output, o",
+							Usage: "Bundle file (default: standard output)",
+						},
+					},
+					Action: exitOnError(createBundle),
+				},
+				{
+					Name: "apply",
+					Usage: "Verify a bundle and copy its snapshots in the repository",
+					ArgsUsage: "BUNDLE",
+					Action: exitOnError(applyBundle),
+				},
+			},
+		},
+		{
+			Name: "clone",
+			Usage: "Create a repository from an existing one",
+			ArgsUsage: "SRC",
+			Action: cloneRepo,
+		},
+		{
+			Name: "export",
+			Usage: "Write a snapshot (the last one by default) in an archive",
+			ArgsUsage: "[TIMESTAMP]",
+			Flags: []cli.Flag {
+				cli.StringFlag{
+					Name: "format, f",
+					Usage: "Archive format: tar, tar.gz or zip (default: guessed from output)",
+				},
+				cli.StringFlag{
+					Name: "output, o",
+					Usage: "Output file (default: stdout)",
+				},
+				cli.StringSliceFlag{
+					Name: "path, p",
+					Usage: "Only export the given file or directory (can be repeated)",
+				},
+			},
+			Action: exitOnError(exportSnapshot),
+		},
+		{
+			Name: "import",
+			Usage: "Create a snapshot from a tar archive",
+			ArgsUsage: "ARCHIVE",
+			Flags: []cli.Flag {
+				cli.StringFlag{
+					Name: "at",
+					Usage: "Timestamp of the snapshot (default: now)",
+				},
+			},
+			Action: exitOnError(importArchive),
+		},
 		{
 			Name: "log",
 			Usage: "Show repository logs",
@@ -160,17 +796,127 @@ func main() {
 			},
 			Action: showLogs,
 		},
+		{
+			Name: "mount",
+			Usage: "Mount snapshots as a read-only file system",
+			ArgsUsage: "MOUNTPOINT",
+			Action: mountRepo,
+		},
+		{
+			Name: "pull",
+			Usage: "Copy missing snapshots from another repository",
+			ArgsUsage: "SRC",
+			Action: pullRepo,
+		},
+		{
+			Name: "push",
+			Usage: "Copy missing snapshots to another repository",
+			ArgsUsage: "DEST",
+			Action: pushRepo,
+		},
+		{
+			Name: "rdiff",
+			Usage: "Signature, delta and patch files compatible with librsync's rdiff",
+			Subcommands: []cli.Command{
+				{
+					Name: "signature",
+					Usage: "Write the signature of a basis file",
+					ArgsUsage: "[BASIS [SIGNATURE]]",
+					Flags: []cli.Flag {
+						cli.IntFlag{
+							Name: "block-size, b",
+							Usage: "Block size",
+							Value: 2048,
+						},
+						cli.IntFlag{
+							Name: "sum-size, S",
+							Usage: "Length of the strong sums (default: full length)",
+						},
+						cli.StringFlag{
+							Name: "hash, H",
+							Usage: "Strong hash, blake2 or md4",
+							Value: "blake2",
+						},
+					},
+					Action: exitOnError(rdiffSignature),
+				},
+				{
+					Name: "delta",
+					Usage: "Write the delta between a signature and a new file",
+					ArgsUsage: "SIGNATURE [NEWFILE [DELTA]]",
+					Action: exitOnError(rdiffDelta),
+				},
+				{
+					Name: "patch",
+					Usage: "Apply a delta to a basis file",
+					ArgsUsage: "BASIS [DELTA [NEWFILE]]",
+					Action: exitOnError(rdiffPatch),
+				},
+			},
+		},
+		{
+			Name: "rebuild-bloom",
+			Usage: "Rebuild the bloom filter of weak hashes",
+			Flags: []cli.Flag {
+				cli.IntFlag{
+					Name: "capacity",
+					Usage: "Number of entries (default: twice the number of blocks)",
+				},
+				cli.Float64Flag{
+					Name: "fp-rate",
+					Usage: "False positive rate (default: the current one)",
+				},
+			},
+			Action: rebuildBloom,
+		},
 		{
 			Name: "restore",
 			Aliases: []string{"re"},
 			Usage: "Restore previous snapshot",
 			Action: restoreSnapshot,
 		},
+		{
+			Name: "serve",
+			Usage: "Serve repository over HTTP",
+			Flags: []cli.Flag {
+				cli.StringFlag{
+					Name: "listen, l",
+					Usage: "Address to listen on",
+					Value: "localhost:8080",
+				},
+			},
+			Action: serveRepo,
+		},
 		{
 			Name: "snapshot",
 			Aliases: []string{"sn", "snap"},
 			Usage: "Create snapshot",
-			Action: createSnapshot,
+			Flags: []cli.Flag {
+				cli.BoolFlag{
+					Name: "stdin",
+					Usage: "Snapshot the standard input instead of the directory",
+				},
+				cli.StringFlag{
+					Name: "name",
+					Usage: "File name of the standard input in the snapshot",
+				},
+				cli.BoolFlag{
+					Name: "alone",
+					Usage: "Do not keep the other files of the last snapshot (with --stdin)",
+				},
+			},
+			Action: exitOnError(createSnapshot),
+		},
+		{
+			Name: "unlock",
+			Usage: "Remove stale locks",
+			Flags: []cli.Flag {
+				cli.BoolFlag{
+					Name: "all",
+					Usage: "Remove all locks, even if their process may still be running",
+				},
+			},
+			Action: unlockRepo,
 		},
 		{
 			Name: "status",
@@ -178,6 +924,18 @@ func main() {
 			Usage: "Show changed files in repository",
 			Action: showStatus,
 		},
+		{
+			Name: "web",
+			Usage: "Browse snapshots with a web browser",
+			Flags: []cli.Flag {
+				cli.StringFlag{
+					Name: "listen, l",
+					Usage: "Address to listen on",
+					Value: "localhost:8080",
+				},
+			},
+			Action: browseRepo,
+		},
 	}
 
 	app.Flags = []cli.Flag {
@@ -185,6 +943,23 @@ func main() {
 			Name: "dry-run, n",
 			Usage: "Dry run",
 		},
+		cli.BoolFlag{
+			Name: "checksum, c",
+			Usage: "Always re-hash files instead of trusting their metadata",
+		},
+		cli.StringFlag{
+			Name: "remote",
+			Usage: "Url of a remote repository (see serve), s3://bucket/prefix or sqlite://path",
+		},
+		cli.DurationFlag{
+			Name: "lock-wait",
+			Usage: "How long to wait for a locked repository",
+		},
+		cli.IntFlag{
+			Name: "jobs, j",
+			Usage: "Number of files to chunk concurrently",
+			Value: runtime.NumCPU(),
+		},
 		cli.StringFlag{
 			Name: "root, r",
 			Usage: "Root of repository",
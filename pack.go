@@ -0,0 +1,449 @@
+package enki
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw" // See also https://github.com/pierrec/lz4
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	packFooterSize = 12
+	// Maximum number of sealed packs kept open for reading
+	maxOpenPacks = 64
+)
+
+var packMagic = []byte("NKPK")
+
+// Packs are sealed once they grow past this size
+var packSize int64 = 64 << 20
+
+// Entry of the trailing index of a pack, Weak is only set for blocks
+// (and is zero in packs sealed before it was added)
+type PackIndexEntry struct {
+	Key    []byte
+	Offset int64
+	Weak   WeakHash
+}
+
+// PackStore stores records in a sequence of pack files
+// (<dotDir>/packs/<name>-<id>.pack). Records are appended to the
+// current pack, once it exceeds packSize it is sealed: the list of its
+// records is appended to it and the pack is never modified again. The
+// global index (the bolt bucket) maps each key to a pack id and an
+// offset, while the keys of the current pack are also kept in their own
+// bucket, to build its trailing index when it is sealed.
+//
+// Each record is the size of the data (4 bytes) followed by the
+// lzw-compressed data. A sealed pack ends with the gob-encoded index
+// ([]PackIndexEntry), the offset of that index (8 bytes) and a magic
+// number (4 bytes). S3Backend uploads packs in the same format.
+//
+// Repositories created before packs existed keep a single <name>.blob
+// file, it is still read (index values of 8 bytes) but never written.
+type PackStore struct {
+	dir        string
+	name       string
+	bucketName []byte
+	bucket     *bolt.Bucket
+	current    *bolt.Bucket
+	tx         *bolt.Tx
+	legacy     *os.File
+	file       *os.File
+	currentId  uint32
+	readers    map[uint32]*os.File
+	readOnly   bool
+}
+
+// Open the pack store, and discard what a crashed process may have
+// left behind (unless readOnly is set)
+func NewPackStore(dotDir, name, bucketName string, tx *bolt.Tx, readOnly bool) *PackStore {
+	self := &PackStore{
+		dir:        path.Join(dotDir, "packs"),
+		name:       name,
+		bucketName: []byte(bucketName),
+		readers:    make(map[uint32]*os.File),
+		readOnly:   readOnly,
+	}
+	legacy, err := os.Open(path.Join(dotDir, name+".blob"))
+	if err == nil {
+		self.legacy = legacy
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+	self.Bind(tx)
+
+	if readOnly {
+		self.currentId, _ = self.committed()
+		return self
+	}
+	check(os.MkdirAll(self.dir, 0750))
+	self.recover()
+	return self
+}
+
+// Fetch the buckets from the given transaction
+func (self *PackStore) Bind(tx *bolt.Tx) {
+	var err error
+	self.tx = tx
+	currentName := self.currentName()
+	if self.readOnly {
+		self.bucket = tx.Bucket(self.bucketName)
+		self.current = tx.Bucket(currentName)
+		return
+	}
+	self.bucket, err = tx.CreateBucketIfNotExists(self.bucketName)
+	check(err)
+	self.current, err = tx.CreateBucketIfNotExists(currentName)
+	check(err)
+}
+
+func (self *PackStore) currentName() []byte {
+	return []byte(self.name + "-pack")
+}
+
+func (self *PackStore) metaKey() []byte {
+	return []byte(self.name + ".pack")
+}
+
+func (self *PackStore) packPath(id uint32) string {
+	return path.Join(self.dir, fmt.Sprintf("%v-%08d.pack", self.name, id))
+}
+
+// Returns the id of the current pack and its size as recorded on last
+// commit (with an id of zero if nothing was ever committed)
+func (self *PackStore) committed() (uint32, int64) {
+	meta := self.tx.Bucket([]byte("meta"))
+	if meta == nil {
+		return 0, 0
+	}
+	value := meta.Get(self.metaKey())
+	if value == nil {
+		return 0, 0
+	}
+	return binary.LittleEndian.Uint32(value), int64(binary.LittleEndian.Uint64(value[4:]))
+}
+
+// Compare the packs with the state recorded on last commit. Packs
+// created after it are removed and the current pack is truncated to its
+// committed size (which also undoes a seal that was not committed). A
+// pack shorter than its committed size means that committed data was
+// lost: index entries pointing past its end are removed, so those
+// records are written again by the next snapshot that needs them.
+func (self *PackStore) recover() {
+	id, committed := self.committed()
+	if id == 0 {
+		id = 1
+	}
+	for _, other := range self.packIds() {
+		if other > id {
+			log.Printf("Discard uncommitted pack %v", self.packPath(other))
+			check(os.Remove(self.packPath(other)))
+		}
+	}
+	self.open(id)
+	size := self.Size()
+	if size > committed {
+		log.Printf("Discard %v bytes of uncommitted data in %v", size-committed, self.packPath(id))
+		check(self.file.Truncate(committed))
+	} else if size < committed {
+		self.dropDangling(size)
+	}
+}
+
+// Ids of the packs found on disk, in increasing order
+func (self *PackStore) packIds() []uint32 {
+	matches, err := filepath.Glob(path.Join(self.dir, self.name+"-*.pack"))
+	check(err)
+	var ids []uint32
+	for _, match := range matches {
+		var id uint32
+		_, err := fmt.Sscanf(path.Base(match), self.name+"-%08d.pack", &id)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (self *PackStore) open(id uint32) {
+	file, err := os.OpenFile(self.packPath(id), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	check(err)
+	self.file = file
+	self.currentId = id
+}
+
+func (self *PackStore) dropDangling(size int64) {
+	var dangling [][]byte
+	var lastKey []byte
+	var lastPos int64 = -1
+	cursor := self.current.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		position := int64(binary.LittleEndian.Uint64(value))
+		if position+4 > size {
+			dangling = append(dangling, concat(key))
+		} else if position > lastPos {
+			lastKey, lastPos = concat(key), position
+		}
+	}
+
+	// Only the last record can be partially written
+	if lastKey != nil && !self.readable(lastKey) {
+		dangling = append(dangling, lastKey)
+		check(self.file.Truncate(lastPos))
+	}
+
+	for _, key := range dangling {
+		check(self.bucket.Delete(key))
+		check(self.current.Delete(key))
+	}
+	log.Printf("Found %v dangling entries in %v", len(dangling), self.packPath(self.currentId))
+}
+
+func (self *PackStore) readable(key []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	self.Read(key)
+	return true
+}
+
+// Size of the current pack
+func (self *PackStore) Size() int64 {
+	size, err := self.file.Seek(0, os.SEEK_END)
+	check(err)
+	return size
+}
+
+// Sync the current pack and record its id and size in the meta bucket
+func (self *PackStore) Commit(meta *bolt.Bucket) {
+	check(self.file.Sync())
+	value := make([]byte, 12)
+	binary.LittleEndian.PutUint32(value, self.currentId)
+	binary.LittleEndian.PutUint64(value[4:], uint64(self.Size()))
+	check(meta.Put(self.metaKey(), value))
+}
+
+func (self *PackStore) Write(key []byte, weak WeakHash, data []byte) {
+	if self.bucket.Get(key) != nil {
+		// Key already known, nothing to do
+		return
+	}
+
+	// Store future data position (current pack size) in buckets,
+	// the weak hash is kept for the trailing index
+	size := self.Size()
+	position := make([]byte, 12)
+	binary.LittleEndian.PutUint64(position, uint64(size))
+	binary.LittleEndian.PutUint32(position[8:], uint32(weak))
+	check(self.current.Put(key, position))
+	value := make([]byte, 12)
+	binary.LittleEndian.PutUint32(value, self.currentId)
+	copy(value[4:], position[:8])
+	check(self.bucket.Put(key, value))
+
+	var buf bytes.Buffer
+	check(writePackRecord(&buf, data))
+	_, err := self.file.Write(buf.Bytes())
+	check(err)
+
+	if size+int64(buf.Len()) >= packSize {
+		self.seal()
+	}
+}
+
+// Append the trailing index to the current pack and start a new one
+func (self *PackStore) seal() {
+	var entries []PackIndexEntry
+	cursor := self.current.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		entry := PackIndexEntry{Key: concat(key), Offset: int64(binary.LittleEndian.Uint64(value))}
+		if len(value) >= 12 {
+			entry.Weak = WeakHash(binary.LittleEndian.Uint32(value[8:]))
+		}
+		entries = append(entries, entry)
+	}
+	_, err := self.file.Write(encodePackIndex(entries, self.Size()))
+	check(err)
+	check(self.file.Sync())
+	check(self.file.Close())
+
+	check(self.tx.DeleteBucket(self.currentName()))
+	self.current, err = self.tx.CreateBucket(self.currentName())
+	check(err)
+	self.open(self.currentId + 1)
+}
+
+func (self *PackStore) Has(key []byte) bool {
+	return self.bucket.Get(key) != nil
+}
+
+func (self *PackStore) Read(key []byte) []byte {
+	// Unknown key, return nil
+	value := self.bucket.Get(key)
+	if value == nil {
+		return nil
+	}
+
+	var file *os.File
+	var position int64
+	if len(value) == 8 {
+		if self.legacy == nil {
+			panic(fmt.Sprintf("Missing %v.blob", self.name))
+		}
+		file = self.legacy
+		position = int64(binary.LittleEndian.Uint64(value))
+	} else {
+		file = self.reader(binary.LittleEndian.Uint32(value))
+		position = int64(binary.LittleEndian.Uint64(value[4:]))
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, position, math.MaxInt64-position))
+	data, err := readPackRecord(reader)
+	check(err)
+	return data
+}
+
+func (self *PackStore) reader(id uint32) *os.File {
+	if id == self.currentId && self.file != nil {
+		return self.file
+	}
+	if file, ok := self.readers[id]; ok {
+		return file
+	}
+	if len(self.readers) >= maxOpenPacks {
+		self.closeReaders()
+	}
+	file, err := os.Open(self.packPath(id))
+	check(err)
+	self.readers[id] = file
+	return file
+}
+
+func (self *PackStore) closeReaders() {
+	for id, file := range self.readers {
+		check(file.Close())
+		delete(self.readers, id)
+	}
+}
+
+func (self *PackStore) Close() {
+	self.closeReaders()
+	if self.file != nil {
+		check(self.file.Close())
+	}
+	if self.legacy != nil {
+		check(self.legacy.Close())
+	}
+}
+
+// Returns the trailing index of a sealed pack
+func ReadPackIndex(packPath string) ([]PackIndexEntry, error) {
+	file, err := os.Open(packPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	footer := make([]byte, packFooterSize)
+	if info.Size() < packFooterSize {
+		return nil, fmt.Errorf("Pack '%v' is not sealed", packPath)
+	}
+	_, err = file.ReadAt(footer, info.Size()-packFooterSize)
+	if err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	if !bytes.Equal(footer[8:], packMagic) || indexOffset > info.Size()-packFooterSize {
+		return nil, fmt.Errorf("Pack '%v' is not sealed", packPath)
+	}
+	tail := make([]byte, info.Size()-indexOffset)
+	_, err = file.ReadAt(tail, indexOffset)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := decodePackIndex(tail)
+	if err != nil {
+		return nil, fmt.Errorf("Pack '%v': %v", packPath, err)
+	}
+	return entries, nil
+}
+
+// Appends a record (data size and lzw-compressed data) to w
+func writePackRecord(w io.Writer, data []byte) error {
+	dataSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(dataSize, uint32(len(data)))
+	_, err := w.Write(dataSize)
+	if err != nil {
+		return err
+	}
+	zipWriter := lzw.NewWriter(w, lzw.LSB, 8)
+	_, err = zipWriter.Write(data)
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+func readPackRecord(r io.Reader) ([]byte, error) {
+	// The first 4 bytes encode the size of the following data
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header))
+	zipReader := lzw.NewReader(r, lzw.LSB, 8)
+	defer zipReader.Close()
+	_, err = io.ReadFull(zipReader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the tail of a sealed pack whose records end at indexOffset:
+// the index sorted by offset, followed by the footer
+func encodePackIndex(entries []PackIndexEntry, indexOffset int64) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Offset < entries[j].Offset
+	})
+	var buf bytes.Buffer
+	check(gob.NewEncoder(&buf).Encode(entries))
+	footer := make([]byte, packFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(indexOffset))
+	copy(footer[8:], packMagic)
+	buf.Write(footer)
+	return buf.Bytes()
+}
+
+// Decodes the tail of a sealed pack, returns its index and the offset
+// of the index in the pack
+func decodePackIndex(tail []byte) ([]PackIndexEntry, int64, error) {
+	if len(tail) < packFooterSize || !bytes.Equal(tail[len(tail)-4:], packMagic) {
+		return nil, 0, fmt.Errorf("Invalid pack index")
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(tail[len(tail)-packFooterSize:]))
+	var entries []PackIndexEntry
+	dec := gob.NewDecoder(bytes.NewReader(tail[:len(tail)-packFooterSize]))
+	err := dec.Decode(&entries)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, indexOffset, nil
+}
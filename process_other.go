@@ -0,0 +1,9 @@
+//go:build !unix
+
+package enki
+
+// Without a portable way to probe a process, locks are never
+// considered stale (use nk unlock --all)
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package enki
+
+import (
+	"syscall"
+)
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
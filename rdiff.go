@@ -0,0 +1,321 @@
+package enki
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+	"hash"
+	"io"
+)
+
+// Magic numbers of the librsync file formats
+const (
+	RDIFF_MD4_SIG_MAGIC    = 0x72730136
+	RDIFF_BLAKE2_SIG_MAGIC = 0x72730137
+	RDIFF_DELTA_MAGIC      = 0x72730236
+)
+
+const (
+	// Delta commands: literals of 1 to 64 bytes have their own
+	// command, longer ones and copies are followed by their
+	// parameters, on 1, 2, 4 or 8 bytes
+	rdiffOpEnd       = 0x00
+	rdiffOpLiteral64 = 0x40
+	rdiffOpLiteralN1 = 0x41
+	rdiffOpCopyN1N1  = 0x45
+	rdiffOpCopyN8N8  = 0x54
+	// librsync adds this offset to every byte in its rollsum
+	rollsumCharOffset = 31
+	rdiffBlockLen     = 2048
+)
+
+type RdiffOptions struct {
+	// RDIFF_BLAKE2_SIG_MAGIC (the default) or RDIFF_MD4_SIG_MAGIC
+	Magic uint32
+	// Defaults to 2048
+	BlockLen int
+	// Length of the strong sums, defaults to the full hash length
+	StrongLen int
+}
+
+// Signature read from a librsync signature file
+type rdiffSignature struct {
+	magic     uint32
+	blockLen  int
+	strongLen int
+	// Index of the blocks for each rollsum
+	weaks   map[WeakHash][]int
+	strongs [][]byte
+}
+
+// Write the librsync signature of r in w, like `rdiff signature`
+func RdiffSignature(r io.Reader, w io.Writer, options RdiffOptions) (err error) {
+	defer recoverError(&err)
+	if options.Magic == 0 {
+		options.Magic = RDIFF_BLAKE2_SIG_MAGIC
+	}
+	if options.BlockLen == 0 {
+		options.BlockLen = rdiffBlockLen
+	}
+	newHash, err := rdiffStrongHash(options.Magic)
+	if err != nil {
+		return err
+	}
+	if options.StrongLen == 0 || options.StrongLen > newHash().Size() {
+		options.StrongLen = newHash().Size()
+	}
+
+	bw := bufio.NewWriter(w)
+	header := []uint32{options.Magic, uint32(options.BlockLen), uint32(options.StrongLen)}
+	check(binary.Write(bw, binary.BigEndian, header))
+	block := make([]byte, options.BlockLen)
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			break
+		}
+		if err != io.ErrUnexpectedEOF {
+			check(err)
+		}
+		weak, _, _ := GetWeakHash(block[:n])
+		check(binary.Write(bw, binary.BigEndian, uint32(rollsum(weak, n))))
+		strong := newHash()
+		strong.Write(block[:n])
+		_, err = bw.Write(strong.Sum(nil)[:options.StrongLen])
+		check(err)
+		if n < len(block) {
+			break
+		}
+	}
+	return bw.Flush()
+}
+
+// Write in w the librsync delta between the file whose signature is
+// read from sig and the new content in r, like `rdiff delta`
+func RdiffDelta(sig io.Reader, r io.Reader, w io.Writer) (err error) {
+	defer recoverError(&err)
+	signature, err := readRdiffSignature(sig)
+	if err != nil {
+		return err
+	}
+	newHash, _ := rdiffStrongHash(signature.magic)
+	bw := bufio.NewWriter(w)
+	check(binary.Write(bw, binary.BigEndian, uint32(RDIFF_DELTA_MAGIC)))
+	matcher := &deltaMatcher{
+		signature: signature,
+		newHash:   newHash,
+		w:         bw,
+	}
+	matchBlocks(r, int64(signature.blockLen), matcher)
+	matcher.flush()
+	check(bw.WriteByte(rdiffOpEnd))
+	return bw.Flush()
+}
+
+// Apply the librsync delta read from delta to basis and write the
+// result in w, like `rdiff patch`
+func RdiffPatch(basis io.ReaderAt, delta io.Reader, w io.Writer) (err error) {
+	defer recoverError(&err)
+	br := bufio.NewReader(delta)
+	var magic uint32
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+	if magic != RDIFF_DELTA_MAGIC {
+		return fmt.Errorf("Not a delta file (magic %#x)", magic)
+	}
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return errors.New("Truncated delta")
+		}
+		check(err)
+		switch {
+		case op == rdiffOpEnd:
+			return nil
+		case op <= rdiffOpLiteral64:
+			_, err = io.CopyN(w, br, int64(op))
+		case op < rdiffOpCopyN1N1:
+			length := readRdiffInt(br, 1<<(op-rdiffOpLiteralN1))
+			_, err = io.CopyN(w, br, length)
+		case op <= rdiffOpCopyN8N8:
+			widths := op - rdiffOpCopyN1N1
+			offset := readRdiffInt(br, 1<<(widths/4))
+			length := readRdiffInt(br, 1<<(widths%4))
+			_, err = io.CopyN(w, io.NewSectionReader(basis, offset, length), length)
+		default:
+			return fmt.Errorf("Unknown delta command %#x", op)
+		}
+		if err == io.EOF {
+			return errors.New("Truncated delta or basis")
+		}
+		check(err)
+	}
+}
+
+// Converts a weak hash (of a block of n bytes) to the librsync
+// rollsum, which offsets every byte
+func rollsum(weak WeakHash, n int) WeakHash {
+	a := uint64(weak%M) + uint64(n)*rollsumCharOffset
+	b := uint64(weak/M) + uint64(n)*uint64(n+1)/2*rollsumCharOffset
+	return WeakHash(a%M + M*(b%M))
+}
+
+func rdiffStrongHash(magic uint32) (func() hash.Hash, error) {
+	switch magic {
+	case RDIFF_MD4_SIG_MAGIC:
+		return md4.New, nil
+	case RDIFF_BLAKE2_SIG_MAGIC:
+		return func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		}, nil
+	}
+	// The RabinKarp variants (rdiff's default since librsync 2.2)
+	// can not be computed with GetWeakHash
+	return nil, fmt.Errorf("Unsupported signature type %#x (use rdiff -R rollsum)", magic)
+}
+
+func readRdiffSignature(r io.Reader) (*rdiffSignature, error) {
+	br := bufio.NewReader(r)
+	var header [3]uint32
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	newHash, err := rdiffStrongHash(header[0])
+	if err != nil {
+		return nil, err
+	}
+	signature := &rdiffSignature{
+		magic:     header[0],
+		blockLen:  int(header[1]),
+		strongLen: int(header[2]),
+		weaks:     make(map[WeakHash][]int),
+	}
+	if signature.blockLen <= 0 || signature.blockLen > 1<<30 ||
+		signature.strongLen <= 0 || signature.strongLen > newHash().Size() {
+		return nil, errors.New("Invalid signature header")
+	}
+	for {
+		var weak uint32
+		err := binary.Read(br, binary.BigEndian, &weak)
+		if err == io.EOF {
+			return signature, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		strong := make([]byte, signature.strongLen)
+		if _, err := io.ReadFull(br, strong); err != nil {
+			return nil, err
+		}
+		idx := len(signature.strongs)
+		signature.weaks[WeakHash(weak)] = append(signature.weaks[WeakHash(weak)], idx)
+		signature.strongs = append(signature.strongs, strong)
+	}
+}
+
+func readRdiffInt(r io.Reader, width int) int64 {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf[8-width:])
+	check(err)
+	value := int64(binary.BigEndian.Uint64(buf))
+	if value < 0 {
+		panic("Invalid delta command")
+	}
+	return value
+}
+
+// Writes delta commands, consecutive copies are merged
+type deltaMatcher struct {
+	signature *rdiffSignature
+	newHash   func() hash.Hash
+	w         *bufio.Writer
+	// Blocks found by searchWeak, and the one found by searchStrong
+	candidates []int
+	match      int
+	// Pending copy
+	offset, length int64
+}
+
+func (self *deltaMatcher) searchWeak(weak WeakHash) bool {
+	self.candidates = self.signature.weaks[rollsum(weak, self.signature.blockLen)]
+	return len(self.candidates) > 0
+}
+
+func (self *deltaMatcher) searchStrong(block Block) bool {
+	strong := self.newHash()
+	strong.Write(block)
+	sum := strong.Sum(nil)[:self.signature.strongLen]
+	for _, idx := range self.candidates {
+		if bytes.Equal(sum, self.signature.strongs[idx]) {
+			self.match = idx
+			return true
+		}
+	}
+	return false
+}
+
+func (self *deltaMatcher) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	self.flush()
+	if len(data) <= rdiffOpLiteral64 {
+		check(self.w.WriteByte(byte(len(data))))
+	} else {
+		width := rdiffIntWidth(int64(len(data)))
+		check(self.w.WriteByte(rdiffOpLiteralN1 + width))
+		writeRdiffInt(self.w, int64(len(data)), width)
+	}
+	_, err := self.w.Write(data)
+	check(err)
+}
+
+func (self *deltaMatcher) reference(weak WeakHash, block Block) {
+	offset := int64(self.match) * int64(self.signature.blockLen)
+	if self.length > 0 && self.offset+self.length == offset {
+		self.length += int64(len(block))
+		return
+	}
+	self.flush()
+	self.offset, self.length = offset, int64(len(block))
+}
+
+// Write the pending copy
+func (self *deltaMatcher) flush() {
+	if self.length == 0 {
+		return
+	}
+	offsetWidth := rdiffIntWidth(self.offset)
+	lengthWidth := rdiffIntWidth(self.length)
+	check(self.w.WriteByte(rdiffOpCopyN1N1 + offsetWidth*4 + lengthWidth))
+	writeRdiffInt(self.w, self.offset, offsetWidth)
+	writeRdiffInt(self.w, self.length, lengthWidth)
+	self.length = 0
+}
+
+// Returns the index (0 to 3) of the smallest width (1, 2, 4 or 8
+// bytes) able to hold value
+func rdiffIntWidth(value int64) byte {
+	switch {
+	case value < 1<<8:
+		return 0
+	case value < 1<<16:
+		return 1
+	case value < 1<<32:
+		return 2
+	}
+	return 3
+}
+
+func writeRdiffInt(w *bufio.Writer, value int64, width byte) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(value))
+	_, err := w.Write(buf[8-(1<<width):])
+	check(err)
+}
@@ -0,0 +1,67 @@
+"""Reference librsync signatures for rdiff_test.go, computed without
+enki: rollsum and md4 follow librsync's sources (rollsum.h, mdfour.c),
+blake2b comes from hashlib."""
+from hashlib import blake2b
+import struct
+
+BLOCK_LEN = 2048
+CHAR_OFFSET = 31
+
+
+def content(n):
+    return bytes((i * i + i // 7) % 256 for i in range(n))
+
+
+def rollsum(block):
+    s1 = s2 = 0
+    for c in block:
+        s1 = (s1 + c + CHAR_OFFSET) & 0xffff
+        s2 = (s2 + s1) & 0xffff
+    return s2 << 16 | s1
+
+
+def md4(data):
+    def f(x, y, z): return x & y | ~x & z
+    def g(x, y, z): return x & y | x & z | y & z
+    def h(x, y, z): return x ^ y ^ z
+    def rotl(x, s): return (x << s | x >> (32 - s)) & 0xffffffff
+
+    size = len(data)
+    data += b'\x80' + b'\x00' * ((55 - size) % 64) + struct.pack('<Q', size * 8)
+    state = [0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476]
+    for pos in range(0, len(data), 64):
+        x = struct.unpack('<16I', data[pos:pos + 64])
+        a, b, c, d = state
+        for i in range(16):
+            k, s = i, (3, 7, 11, 19)[i % 4]
+            a = rotl((a + f(b, c, d) + x[k]) & 0xffffffff, s)
+            a, b, c, d = d, a, b, c
+        for i in range(16):
+            k, s = (i % 4) * 4 + i // 4, (3, 5, 9, 13)[i % 4]
+            a = rotl((a + g(b, c, d) + x[k] + 0x5a827999) & 0xffffffff, s)
+            a, b, c, d = d, a, b, c
+        for i in range(16):
+            k = (0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15)[i]
+            s = (3, 9, 11, 15)[i % 4]
+            a = rotl((a + h(b, c, d) + x[k] + 0x6ed9eba1) & 0xffffffff, s)
+            a, b, c, d = d, a, b, c
+        state = [(v + w) & 0xffffffff for v, w in zip(state, (a, b, c, d))]
+    return struct.pack('<4I', *state)
+
+
+def signature(data, magic, strong, strong_len):
+    out = struct.pack('>III', magic, BLOCK_LEN, strong_len)
+    for pos in range(0, len(data), BLOCK_LEN):
+        block = data[pos:pos + BLOCK_LEN]
+        out += struct.pack('>I', rollsum(block)) + strong(block)[:strong_len]
+    return out
+
+
+assert md4(b'').hex() == '31d6cfe0d16ae931b73c59d7e0c089c0'
+assert md4(b'abc').hex() == 'a448017aaf21d8525fc10ae87aa6729d'
+assert md4(b'1234567890' * 8).hex() == 'e33b4ddc9c38f2199c3e7b164fcc0536'
+
+basis = content(5000)
+print('blake2', signature(basis, 0x72730137,
+                          lambda b: blake2b(b, digest_size=32).digest(), 32).hex())
+print('md4', signature(basis, 0x72730136, md4, 16).hex())
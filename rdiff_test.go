@@ -0,0 +1,118 @@
+package enki
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func TestRollsum(t *testing.T) {
+	// Straight port of librsync's RollsumUpdate
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(data)
+	var s1, s2 uint16
+	for _, c := range data {
+		s1 += uint16(c)
+		s2 += s1
+	}
+	n := uint64(len(data))
+	s1 += uint16(n * rollsumCharOffset)
+	s2 += uint16(n * (n + 1) / 2 * rollsumCharOffset)
+	weak, _, _ := GetWeakHash(data)
+	if rollsum(weak, len(data)) != WeakHash(s2)<<16|WeakHash(s1) {
+		t.Errorf("Rollsum mismatch")
+	}
+}
+
+func TestRdiff(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 200000)
+	rnd.Read(basis)
+	// Insert, change and remove some data
+	insert := make([]byte, 1000)
+	rnd.Read(insert)
+	content := concat(basis[:50000], insert, basis[50000:120000],
+		[]byte("changed"), basis[120100:190000])
+
+	for _, magic := range []uint32{RDIFF_BLAKE2_SIG_MAGIC, RDIFF_MD4_SIG_MAGIC} {
+		var sig, delta, patched bytes.Buffer
+		options := RdiffOptions{Magic: magic, StrongLen: 8}
+		check(RdiffSignature(bytes.NewReader(basis), &sig, options))
+		// 12 bytes of header, 12 bytes per block
+		if sig.Len() != 12+12*(len(basis)/rdiffBlockLen+1) {
+			t.Errorf("Unexpected signature size %v", sig.Len())
+		}
+		check(RdiffDelta(&sig, bytes.NewReader(content), &delta))
+		if delta.Len() > 10000 {
+			t.Errorf("Delta too big: %v bytes", delta.Len())
+		}
+		check(RdiffPatch(bytes.NewReader(basis), &delta, &patched))
+		if !bytes.Equal(patched.Bytes(), content) {
+			t.Errorf("Patched content mismatch")
+		}
+	}
+
+	// Truncated or invalid inputs are errors
+	var sig, delta bytes.Buffer
+	check(RdiffSignature(bytes.NewReader(basis), &sig, RdiffOptions{}))
+	check(RdiffDelta(&sig, bytes.NewReader(content), &delta))
+	truncated := delta.Bytes()[:delta.Len()-1]
+	if RdiffPatch(bytes.NewReader(basis), bytes.NewReader(truncated), &bytes.Buffer{}) == nil {
+		t.Errorf("Truncated delta should fail")
+	}
+	if RdiffPatch(bytes.NewReader(basis[:1000]), &delta, &bytes.Buffer{}) == nil {
+		t.Errorf("Short basis should fail")
+	}
+	if RdiffDelta(bytes.NewReader([]byte("rs\x01\x46xxxxxxxx")), bytes.NewReader(content), &delta) == nil {
+		t.Errorf("RabinKarp signatures should be rejected")
+	}
+}
+
+// Signatures of rdiffFixture(5000), computed independently by
+// rdiff_fixtures.py
+var rdiffGoldenSignatures = map[uint32]string{
+	RDIFF_BLAKE2_SIG_MAGIC: "727301370000080000000020" +
+		"f1dce44ae5e9e933bb5453aef2ef2832530dc25d80278f9fbe988db1b64146c22a5cc8ad" +
+		"316deedb58a9e55dce4aebe3573f09c046170fe7edae4e0165cd68c86a4cb06f44803214" +
+		"fd3341ceb175c89a818179c8d01be0df4ad09232e03a81f0896c60e718b9f07629e7dc25",
+	RDIFF_MD4_SIG_MAGIC: "727301360000080000000010" +
+		"f1dce44a368d03dd9f7493e1ac8829e2e1fa8a53" +
+		"316deedb3af248dab0db290cecf453655f7304fc" +
+		"fd3341ce0d61bc83e53f0f00648e4f85466736e6",
+}
+
+func rdiffFixture(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*i + i/7)
+	}
+	return data
+}
+
+func TestRdiffFormat(t *testing.T) {
+	basis := rdiffFixture(5000)
+	for magic, golden := range rdiffGoldenSignatures {
+		var sig bytes.Buffer
+		check(RdiffSignature(bytes.NewReader(basis), &sig, RdiffOptions{Magic: magic}))
+		if hex.EncodeToString(sig.Bytes()) != golden {
+			t.Errorf("Signature %#x mismatch: %x", magic, sig.Bytes())
+		}
+	}
+
+	// Delta using every kind of command
+	delta, err := hex.DecodeString("72730236" +
+		"4a" + "0000" + "0800" + // copy 2048 bytes at 0 (N2 offset, N2 length)
+		"05" + hex.EncodeToString([]byte("hello")) + // literal of 5 bytes
+		"4a" + "0bb8" + "07d0" + // copy 2000 bytes at 3000
+		"45" + "10" + "20" + // copy 32 bytes at 16 (N1, N1)
+		"41" + "03" + hex.EncodeToString([]byte("end")) + // literal, N1 length
+		"00")
+	check(err)
+	var patched bytes.Buffer
+	check(RdiffPatch(bytes.NewReader(basis), bytes.NewReader(delta), &patched))
+	expected := concat(basis[:2048], []byte("hello"), basis[3000:5000], basis[16:48], []byte("end"))
+	if !bytes.Equal(patched.Bytes(), expected) {
+		t.Errorf("Patched content mismatch")
+	}
+}
@@ -0,0 +1,175 @@
+package enki
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// SignatureReader gives random access to the content described by a
+// signature. Segments are located through a cumulative offset index,
+// so a read only fetches the blocks (and index chunks) covering the
+// requested range.
+//
+// Segments of signatures recorded before sizes were have to be read
+// to be located, the index is then extended on demand, up to the
+// requested offset.
+type SignatureReader struct {
+	backend  Backend
+	segments []Segment
+	// offsets[i] is the position of segments[i], the last entry is the
+	// end of the last located segment
+	offsets []int64
+	// Reader of the last index chunk read, only the readers on the
+	// current path are kept so memory stays bounded by the depth of
+	// the signature
+	chunkIdx int
+	chunk    *SignatureReader
+	// Last block read
+	cacheIdx int
+	cache    []byte
+	pos      int64
+	mutex    sync.Mutex
+}
+
+func NewSignatureReader(backend Backend, sgn *Signature) *SignatureReader {
+	return &SignatureReader{
+		backend:  backend,
+		segments: sgn.Segments,
+		offsets:  []int64{0},
+		chunkIdx: -1,
+		cacheIdx: -1,
+	}
+}
+
+// Size of the content
+func (self *SignatureReader) Size() (size int64, err error) {
+	defer recoverError(&err)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.size(), nil
+}
+
+func (self *SignatureReader) size() int64 {
+	self.locate(1<<63 - 1)
+	return self.offsets[len(self.offsets)-1]
+}
+
+func (self *SignatureReader) block(idx int) []byte {
+	if self.cacheIdx != idx {
+		data := self.backend.ReadStrong(self.segments[idx].Stronghash)
+		if data == nil {
+			panic("Hash not found in backend")
+		}
+		self.cacheIdx, self.cache = idx, data
+	}
+	return self.cache
+}
+
+func (self *SignatureReader) chunkReader(idx int) *SignatureReader {
+	if self.chunkIdx != idx {
+		sgn := self.backend.ReadSignature(self.segments[idx].Stronghash[:])
+		if sgn == nil {
+			panic("Signature chunk not found in backend")
+		}
+		self.chunkIdx, self.chunk = idx, NewSignatureReader(self.backend, sgn)
+	}
+	return self.chunk
+}
+
+func (self *SignatureReader) segmentSize(idx int) int64 {
+	segment := &self.segments[idx]
+	if size := segment.contentSize(); size > 0 || segment.Mode == DATA_SGM {
+		return size
+	}
+	if segment.Mode == INDEX_SGM {
+		return self.chunkReader(idx).size()
+	}
+	return int64(len(self.block(idx)))
+}
+
+// Returns the index of the segment containing off, len(segments) if
+// off is past the end
+func (self *SignatureReader) locate(off int64) int {
+	for len(self.offsets) <= len(self.segments) && self.offsets[len(self.offsets)-1] <= off {
+		idx := len(self.offsets) - 1
+		self.offsets = append(self.offsets, self.offsets[idx]+self.segmentSize(idx))
+	}
+	return sort.Search(len(self.offsets)-1, func(i int) bool {
+		return self.offsets[i+1] > off
+	})
+}
+
+func (self *SignatureReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	defer recoverError(&err)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	n = self.readAt(p, off)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (self *SignatureReader) readAt(p []byte, off int64) int {
+	n := 0
+	idx := self.locate(off)
+	for n < len(p) && idx < len(self.segments) {
+		if len(self.offsets) == idx+1 {
+			self.offsets = append(self.offsets, self.offsets[idx]+self.segmentSize(idx))
+		}
+		start := off + int64(n) - self.offsets[idx]
+		switch self.segments[idx].Mode {
+		case DATA_SGM:
+			n += copy(p[n:], self.segments[idx].Data[start:])
+		case HASH_SGM:
+			n += copy(p[n:], self.block(idx)[start:])
+		case INDEX_SGM:
+			n += self.chunkReader(idx).readAt(p[n:], start)
+		}
+		idx += 1
+	}
+	return n
+}
+
+func (self *SignatureReader) Read(p []byte) (int, error) {
+	n, err := self.ReadAt(p, self.pos)
+	self.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (self *SignatureReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.pos
+	case io.SeekEnd:
+		size, err := self.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	self.pos = offset
+	return offset, nil
+}
+
+// Backends signal failures by panicking, turn them into errors
+func recoverError(err *error) {
+	if rec := recover(); rec != nil {
+		*err = fmt.Errorf("%v", rec)
+	}
+}
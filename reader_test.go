@@ -0,0 +1,98 @@
+package enki
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Counts the blocks read from the backend
+type countingBackend struct {
+	Backend
+	reads int
+}
+
+func (self *countingBackend) ReadStrong(strong *StrongHash) Block {
+	self.reads += 1
+	return self.Backend.ReadStrong(strong)
+}
+
+func TestSignatureReader(t *testing.T) {
+	// Use small chunks to get index segments
+	defer func(segments int) { chunkSegments = segments }(chunkSegments)
+	chunkSegments = 4
+
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	backend := &countingBackend{Backend: NewMemoryBackend()}
+	sgn := NewBlob(backend).Snapshot(bytes.NewReader(data), int64(len(data)))
+
+	// Signatures recorded before sizes were have no segment sizes
+	legacy := &Signature{}
+	for _, segment := range sgn.Segments {
+		segment.Size = 0
+		legacy.Segments = append(legacy.Segments, segment)
+	}
+
+	for _, s := range []*Signature{sgn, legacy} {
+		reader := NewSignatureReader(backend, s)
+		buf := make([]byte, 1000)
+		backend.reads = 0
+		off := int64(len(data)) - 70000
+		n, err := reader.ReadAt(buf, off)
+		check(err)
+		if n != len(buf) || !bytes.Equal(buf, data[off:off+int64(n)]) {
+			t.Errorf("Unexpected content at offset %v", off)
+		}
+		if s == sgn && backend.reads != 1 {
+			t.Errorf("Read %v blocks instead of 1", backend.reads)
+		}
+
+		// A read across several segments
+		buf = make([]byte, 200000)
+		n, err = reader.ReadAt(buf, 60000)
+		check(err)
+		if n != len(buf) || !bytes.Equal(buf, data[60000:260000]) {
+			t.Errorf("Unexpected content across segments")
+		}
+		size, err := reader.Size()
+		check(err)
+		if size != int64(len(data)) {
+			t.Errorf("Unexpected size %v", size)
+		}
+		_, err = reader.Seek(-10, io.SeekEnd)
+		check(err)
+		tail, err := io.ReadAll(reader)
+		check(err)
+		if !bytes.Equal(tail, data[len(data)-10:]) {
+			t.Errorf("Unexpected tail %v", tail)
+		}
+
+		// A full read only keeps the chunk readers of the current path
+		_, err = reader.Seek(0, io.SeekStart)
+		check(err)
+		content, err := io.ReadAll(reader)
+		check(err)
+		if !bytes.Equal(content, data) {
+			t.Errorf("Unexpected content")
+		}
+		depth := 0
+		for r := reader; r.chunk != nil; r = r.chunk {
+			depth += 1
+		}
+		if depth == 0 || depth > sgnDepth(backend, s) {
+			t.Errorf("Unexpected number of cached chunk readers: %v", depth)
+		}
+	}
+}
+
+// Number of index levels of a signature
+func sgnDepth(backend Backend, sgn *Signature) int {
+	for _, segment := range sgn.Segments {
+		if segment.Mode == INDEX_SGM {
+			return 1 + sgnDepth(backend, backend.ReadSignature(segment.Stronghash[:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package enki
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"log"
+	"sort"
+)
+
+// Commit the destination every time this amount of data is copied
+const checkpointSize = 64 << 20
+
+type ReplicateStats struct {
+	States     int
+	Signatures int
+	Blocks     int
+}
+
+type replicator struct {
+	src     Backend
+	dst     Backend
+	stats   ReplicateStats
+	pending int
+}
+
+// Copy the states (oldest first), signatures and blocks of src that
+// are missing from dst. Blocks are written before the signature
+// chunks that reference them, and signatures before their states, so
+// anything found in dst is known to be complete and an interrupted
+// replication can simply be started again. Every block and signature
+// is verified against its hash before being written.
+func Replicate(src, dst Backend) (ReplicateStats, error) {
+	self := &replicator{src: src, dst: dst}
+	var timestamps []int64
+	for state := LastState(src); state != nil; state = src.ReadState(state.Timestamp - 1) {
+		timestamps = append(timestamps, state.Timestamp)
+	}
+
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		ts := timestamps[i]
+		if found := dst.ReadState(ts); found != nil && found.Timestamp == ts {
+			continue
+		}
+		state := src.ReadState(ts)
+		var names []string
+		for name := range state.FileStates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			err := self.copySignature(state.FileStates[name].SgnSum)
+			if err != nil {
+				return self.stats, fmt.Errorf("%v: %v", name, err)
+			}
+		}
+		log.Print("Copy state ", ts)
+		dst.WriteState(state)
+		self.stats.States++
+		self.checkpoint()
+	}
+	return self.stats, nil
+}
+
+func (self *replicator) checkpoint() {
+	if cp, ok := self.dst.(Checkpointer); ok {
+		cp.Checkpoint()
+	}
+	self.pending = 0
+}
+
+func (self *replicator) copySignature(checksum []byte) error {
+	if self.dst.ReadSignature(checksum) != nil {
+		return nil
+	}
+	sgn := self.src.ReadSignature(checksum)
+	if sgn == nil {
+		return fmt.Errorf("Signature %x not found", checksum)
+	}
+	content := md5.New()
+	err := self.copySegments(sgn, content)
+	if err != nil {
+		return err
+	}
+	// Signatures are indexed by the checksum of the file content (or
+	// of their segments for those created by older versions)
+	if !bytes.Equal(content.Sum(nil), checksum) && !bytes.Equal(sgn.CheckSum(), checksum) {
+		return fmt.Errorf("Signature %x does not match its content", checksum)
+	}
+	self.dst.WriteSignature(checksum, sgn)
+	self.stats.Signatures++
+	return nil
+}
+
+func (self *replicator) copySegments(sgn *Signature, content hash.Hash) error {
+	for _, segment := range sgn.Segments {
+		switch segment.Mode {
+		case DATA_SGM:
+			content.Write(segment.Data)
+		case HASH_SGM:
+			data, err := self.copyBlock(segment.Stronghash)
+			if err != nil {
+				return err
+			}
+			content.Write(data)
+		case INDEX_SGM:
+			key := segment.Stronghash[:]
+			chunk := self.src.ReadSignature(key)
+			if chunk == nil {
+				// Bundles do not hold the chunks shared with
+				// signatures already in dst
+				chunk = self.dst.ReadSignature(key)
+			}
+			if chunk == nil {
+				return fmt.Errorf("Signature chunk %x not found", key)
+			}
+			if !bytes.Equal(chunk.CheckSum(), key) {
+				return fmt.Errorf("Signature chunk %x is corrupted", key)
+			}
+			err := self.copySegments(chunk, content)
+			if err != nil {
+				return err
+			}
+			if self.dst.ReadSignature(key) == nil {
+				self.dst.WriteSignature(key, chunk)
+			}
+		}
+	}
+	return nil
+}
+
+func (self *replicator) copyBlock(strong *StrongHash) (Block, error) {
+	// The content of the blocks already in dst is still needed to
+	// check the signatures, it is read from src when dst is remote
+	inDst := hasBlock(self.dst, strong)
+	if inDst && !isRemoteBackend(self.dst) {
+		return self.dst.ReadStrong(strong), nil
+	}
+	data := self.src.ReadStrong(strong)
+	if data == nil {
+		return nil, fmt.Errorf("Block %x not found", strong[:])
+	}
+	if *GetStrongHash(data) != *strong {
+		return nil, fmt.Errorf("Block %x is corrupted", strong[:])
+	}
+	if inDst {
+		return data, nil
+	}
+	weak, _, _ := GetWeakHash(data)
+	self.dst.AddBlock(weak, strong, data)
+	self.stats.Blocks++
+	self.pending += len(data)
+	if self.pending >= checkpointSize {
+		self.checkpoint()
+	}
+	return data, nil
+}
+
+// Reading a block from those backends means downloading it
+func isRemoteBackend(backend Backend) bool {
+	switch backend.(type) {
+	case *HTTPBackend, *S3Backend:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package enki
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReplicate(t *testing.T) {
+	root := t.TempDir()
+	srcDir := path.Join(t.TempDir(), ".nk")
+	dstDir := path.Join(t.TempDir(), ".nk")
+	check(os.Mkdir(srcDir, 0750))
+	check(os.Mkdir(dstDir, 0750))
+
+	// Two snapshots in the source
+	src := NewBoltBackend(srcDir)
+	for i, name := range []string{"small.data", "big-shifted.data"} {
+		data, err := os.ReadFile(path.Join(test_data, name))
+		check(err)
+		check(os.WriteFile(path.Join(root, name), data, 0644))
+		state := NewDirState(root, src, nil)
+		state.Timestamp += int64(i)
+		state.Snapshot()
+	}
+
+	dst := NewBoltBackend(dstDir)
+	stats, err := Replicate(src, dst)
+	check(err)
+	if stats.States != 2 || stats.Signatures != 2 || stats.Blocks == 0 {
+		t.Errorf("Unexpected stats: %v", stats)
+	}
+	dst.Close()
+
+	// Nothing left to copy
+	dst = NewBoltBackend(dstDir)
+	defer dst.Close()
+	stats, err = Replicate(src, dst)
+	check(err)
+	if stats != (ReplicateStats{}) {
+		t.Errorf("Unexpected stats: %v", stats)
+	}
+	src.Close()
+
+	last := LastState(dst)
+	for name, fst := range last.FileStates {
+		var buf bytes.Buffer
+		check((&Blob{dst}).Restore(fst.SgnSum, &buf))
+		expected, err := os.ReadFile(path.Join(root, name))
+		check(err)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("Content mismatch for %v", name)
+		}
+	}
+}
+
+func TestReplicateRemote(t *testing.T) {
+	root := t.TempDir()
+	dstDir := path.Join(t.TempDir(), ".nk")
+	check(os.Mkdir(dstDir, 0750))
+	serverBackend := NewBoltBackend(dstDir)
+	defer serverBackend.Close()
+	counter := &requestCounter{handler: NewBackendServer(serverBackend)}
+	server := httptest.NewServer(counter)
+	defer server.Close()
+
+	data, err := os.ReadFile(path.Join(test_data, "big-shifted.data"))
+	check(err)
+	src := NewMemoryBackend()
+	check(os.WriteFile(path.Join(root, "a.data"), data, 0644))
+	NewDirState(root, src, nil).Snapshot()
+	dst := NewHTTPBackend(server.URL)
+	_, err = Replicate(src, dst)
+	check(err)
+	dst.Close()
+
+	// The blocks of the new file are already on the server, they
+	// are not downloaded to be checked
+	check(os.WriteFile(path.Join(root, "b.data"), concat(data, []byte("tail")), 0644))
+	state := NewDirState(root, src, nil)
+	state.Timestamp += 1
+	state.Snapshot()
+	dst = NewHTTPBackend(server.URL)
+	stats, err := Replicate(src, dst)
+	check(err)
+	dst.Close()
+	if stats.States != 1 || stats.Signatures != 1 {
+		t.Errorf("Unexpected stats: %v", stats)
+	}
+	if counter.requests["GET /blocks"] != 0 {
+		t.Errorf("Blocks downloaded from the destination: %v", counter.requests)
+	}
+}
@@ -0,0 +1,231 @@
+package enki
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Client is a minimal client for S3-compatible object storages
+// (AWS, MinIO, ...), using path-style urls and signature v4.
+type S3Client struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	client    *http.Client
+}
+
+func NewS3Client(endpoint, bucket, region, accessKey, secretKey string) *S3Client {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Client{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client:    &http.Client{},
+	}
+}
+
+func (self *S3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	path := "/" + self.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	rawQuery := canonicalQuery(query)
+	req, err := http.NewRequest(method, self.Endpoint+encodePath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = rawQuery
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	self.sign(req, body, time.Now().UTC())
+	return self.client.Do(req)
+}
+
+// Sign request with AWS signature version 4
+func (self *S3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+
+	// Canonical headers: host and all x-amz-* and range headers
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := day + "/" + self.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+self.SecretKey), day)
+	key = hmacSHA256(key, self.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		self.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encode everything but unreserved characters (and slashes in
+// paths)
+func uriEncode(value string, keepSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(value) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (keepSlash && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func encodePath(path string) string {
+	return uriEncode(path, true)
+}
+
+func canonicalQuery(query url.Values) string {
+	var parts []string
+	for name, values := range query {
+		for _, value := range values {
+			parts = append(parts, uriEncode(name, false)+"="+uriEncode(value, false))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func s3Error(resp *http.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("S3 %v %v: %v %v", resp.Request.Method, resp.Request.URL.Path,
+		resp.Status, strings.TrimSpace(string(data)))
+}
+
+func (self *S3Client) Put(key string, data []byte) error {
+	resp, err := self.do("PUT", key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// Returns the content of the object, nil if it does not exist
+func (self *S3Client) Get(key string) ([]byte, error) {
+	return self.get(key, nil)
+}
+
+// Returns size bytes of the object starting at offset (less if the
+// object ends before)
+func (self *S3Client) GetRange(key string, offset, size int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+size-1))
+	return self.get(key, header)
+}
+
+func (self *S3Client) get(key string, header http.Header) ([]byte, error) {
+	resp, err := self.do("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, s3Error(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Returns the keys of all the objects starting with prefix
+func (self *S3Client) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	for {
+		resp, err := self.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
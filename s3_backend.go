@@ -0,0 +1,330 @@
+package enki
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Size after which the current pack is uploaded
+	s3PackSize = 16 << 20
+	// Amount of data fetched at once when records are read in the
+	// order they were written (like the blocks of a restored file)
+	s3ReadAhead = 4 << 20
+)
+
+// Location of a record in a pack
+type packLocation struct {
+	pack   string
+	offset int64
+	size   int64
+}
+
+// Records of one kind (blocks or signatures), in the uploaded packs
+// and in the pack being filled
+type s3Packs struct {
+	name      string
+	locations map[string]packLocation
+	pack      bytes.Buffer
+	index     []PackIndexEntry
+	keys      map[string]int
+}
+
+func newS3Packs(name string) *s3Packs {
+	return &s3Packs{
+		name:      name,
+		locations: make(map[string]packLocation),
+		keys:      make(map[string]int),
+	}
+}
+
+func (self *s3Packs) has(key []byte) bool {
+	if _, present := self.keys[string(key)]; present {
+		return true
+	}
+	_, present := self.locations[string(key)]
+	return present
+}
+
+// S3Backend stores blocks and signatures in immutable pack objects,
+// each one followed by an index object holding a copy of its trailing
+// index. States are stored as separate objects. Indexes are cached in
+// a local directory and loaded in memory on open, so lookups never hit
+// the network: pack data is only fetched to read blocks and
+// signatures. Consecutive records of a pack are fetched with a single
+// request.
+//
+// Object layout in the bucket (under an optional prefix):
+//
+//	packs/blocks-<md5>    sealed pack of blocks, see PackStore
+//	packs/sigs-<md5>      sealed pack of signatures
+//	indexes/<pack name>   tail of the pack: its index and footer
+//	states/<ts>           gob-encoded DirState (ts is zero-padded)
+//
+// A pack is always uploaded before its index, so an index found in the
+// bucket always points to complete data.
+type S3Backend struct {
+	client   *S3Client
+	prefix   string
+	cacheDir string
+	blocks   *s3Packs
+	sigs     *s3Packs
+	weaks    map[WeakHash]bool
+	states   []int64
+	// Last range fetched from a pack, and last record read
+	fetched   packLocation
+	fetchData []byte
+	lastRead  packLocation
+}
+
+func NewS3Backend(client *S3Client, prefix string, cacheDir string) Backend {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	check(os.MkdirAll(cacheDir, 0750))
+	backend := &S3Backend{
+		client:   client,
+		prefix:   prefix,
+		cacheDir: cacheDir,
+		blocks:   newS3Packs("blocks"),
+		sigs:     newS3Packs("sigs"),
+		weaks:    make(map[WeakHash]bool),
+	}
+	backend.loadIndexes()
+	backend.loadStates()
+	return backend
+}
+
+// Load all pack indexes, downloading the ones missing from the cache
+func (self *S3Backend) loadIndexes() {
+	keys, err := self.client.List(self.prefix + "indexes/")
+	check(err)
+	for _, key := range keys {
+		name := path.Base(key)
+		packs := self.blocks
+		if strings.HasPrefix(name, self.sigs.name+"-") {
+			packs = self.sigs
+		} else if !strings.HasPrefix(name, self.blocks.name+"-") {
+			continue
+		}
+		cachePath := path.Join(self.cacheDir, name)
+		data, err := os.ReadFile(cachePath)
+		if os.IsNotExist(err) {
+			data, err = self.client.Get(key)
+			check(err)
+			check(os.WriteFile(cachePath, data, 0640))
+		} else {
+			check(err)
+		}
+		entries, indexOffset, err := decodePackIndex(data)
+		if err != nil {
+			panic(fmt.Sprintf("Index %v: %v", name, err))
+		}
+		self.addEntries(packs, name, entries, indexOffset)
+	}
+}
+
+// Register the entries of an uploaded pack, entries are sorted by
+// offset so each record ends where the next one starts
+func (self *S3Backend) addEntries(packs *s3Packs, name string, entries []PackIndexEntry, indexOffset int64) {
+	for i, entry := range entries {
+		end := indexOffset
+		if i+1 < len(entries) {
+			end = entries[i+1].Offset
+		}
+		packs.locations[string(entry.Key)] = packLocation{name, entry.Offset, end - entry.Offset}
+		if packs == self.blocks {
+			self.weaks[entry.Weak] = true
+		}
+	}
+}
+
+func (self *S3Backend) loadStates() {
+	keys, err := self.client.List(self.prefix + "states/")
+	check(err)
+	self.states = nil
+	for _, key := range keys {
+		ts, err := strconv.ParseInt(path.Base(key), 10, 64)
+		if err != nil {
+			continue
+		}
+		self.states = append(self.states, ts)
+	}
+	sort.Slice(self.states, func(i, j int) bool { return self.states[i] < self.states[j] })
+}
+
+func (self *S3Backend) read(packs *s3Packs, key []byte) []byte {
+	if idx, present := packs.keys[string(key)]; present {
+		data, err := readPackRecord(bytes.NewReader(packs.pack.Bytes()[packs.index[idx].Offset:]))
+		check(err)
+		return data
+	}
+	location, present := packs.locations[string(key)]
+	if !present {
+		return nil
+	}
+	sequential := location.pack == self.lastRead.pack &&
+		location.offset == self.lastRead.offset+self.lastRead.size
+	self.lastRead = location
+
+	fetched := self.fetched
+	if location.pack != fetched.pack || location.offset < fetched.offset ||
+		location.offset+location.size > fetched.offset+int64(len(self.fetchData)) {
+		// Fetch the record, and the following ones if reads look
+		// sequential (ranges past the end of the pack are truncated)
+		size := location.size
+		if sequential && size < s3ReadAhead {
+			size = s3ReadAhead
+		}
+		data, err := self.client.GetRange(self.prefix+"packs/"+location.pack,
+			location.offset, size)
+		check(err)
+		if int64(len(data)) < location.size {
+			panic(fmt.Sprintf("Truncated read in pack %v", location.pack))
+		}
+		self.fetched = packLocation{location.pack, location.offset, size}
+		self.fetchData = data
+		fetched = self.fetched
+	}
+	start := location.offset - fetched.offset
+	data, err := readPackRecord(bytes.NewReader(self.fetchData[start : start+location.size]))
+	if err != nil {
+		panic(fmt.Sprintf("Corrupted record in pack %v: %v", location.pack, err))
+	}
+	return data
+}
+
+func (self *S3Backend) write(packs *s3Packs, key []byte, weak WeakHash, data []byte) {
+	if packs.has(key) {
+		return
+	}
+	entry := PackIndexEntry{concat(key), int64(packs.pack.Len()), weak}
+	check(writePackRecord(&packs.pack, data))
+	packs.keys[string(key)] = len(packs.index)
+	packs.index = append(packs.index, entry)
+	if packs == self.blocks {
+		self.weaks[weak] = true
+	}
+	if packs.pack.Len() >= s3PackSize {
+		self.flushPacks(packs)
+	}
+}
+
+// Upload the pending blocks and then the pending signatures
+func (self *S3Backend) flush() {
+	self.flushPacks(self.blocks)
+	self.flushPacks(self.sigs)
+}
+
+// Seal the current pack, upload it and then its index
+func (self *S3Backend) flushPacks(packs *s3Packs) {
+	if len(packs.index) == 0 {
+		return
+	}
+	if packs == self.sigs {
+		// Signatures must not reference blocks not uploaded yet
+		self.flushPacks(self.blocks)
+	}
+	indexOffset := int64(packs.pack.Len())
+	tail := encodePackIndex(packs.index, indexOffset)
+	packs.pack.Write(tail)
+	sum := md5.Sum(packs.pack.Bytes())
+	name := packs.name + "-" + hex.EncodeToString(sum[:])
+	check(self.client.Put(self.prefix+"packs/"+name, packs.pack.Bytes()))
+	check(self.client.Put(self.prefix+"indexes/"+name, tail))
+	check(os.WriteFile(path.Join(self.cacheDir, name), tail, 0640))
+
+	self.addEntries(packs, name, packs.index, indexOffset)
+	packs.pack.Reset()
+	packs.index = nil
+	packs.keys = make(map[string]int)
+}
+
+func (self *S3Backend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	self.write(self.blocks, strong[:], weak, data)
+}
+
+func (self *S3Backend) HasBlock(strong *StrongHash) bool {
+	return self.blocks.has(strong[:])
+}
+
+func (self *S3Backend) SearchWeak(weak WeakHash) bool {
+	return self.weaks[weak]
+}
+
+func (self *S3Backend) ReadStrong(strong *StrongHash) Block {
+	data := self.read(self.blocks, strong[:])
+	if data == nil {
+		return nil
+	}
+	return Block(data)
+}
+
+func (self *S3Backend) ReadSignature(checksum []byte) *Signature {
+	data := self.read(self.sigs, checksum)
+	if data == nil {
+		return nil
+	}
+	sgn := &Signature{}
+	check(sgn.GobDecode(data))
+	return sgn
+}
+
+func (self *S3Backend) WriteSignature(checksum []byte, sgn *Signature) {
+	data, err := sgn.GobEncode()
+	check(err)
+	self.write(self.sigs, checksum, 0, data)
+}
+
+func (self *S3Backend) ReadState(timestamp int64) *DirState {
+	// Last state at or before timestamp
+	pos := sort.Search(len(self.states), func(i int) bool {
+		return self.states[i] > timestamp
+	})
+	if pos == 0 {
+		return nil
+	}
+	data, err := self.client.Get(self.stateKey(self.states[pos-1]))
+	check(err)
+	if data == nil {
+		return nil
+	}
+	state := &DirState{}
+	state.GobDecode(data)
+	return state
+}
+
+func (self *S3Backend) stateKey(timestamp int64) string {
+	// Zero-padded so that keys are listed in chronological order
+	return fmt.Sprintf("%vstates/%020d", self.prefix, timestamp)
+}
+
+func (self *S3Backend) WriteState(state *DirState) {
+	// Signatures and blocks must be uploaded before the state
+	self.flush()
+	check(self.client.Put(self.stateKey(state.Timestamp), state.GobEncode()))
+	pos := sort.Search(len(self.states), func(i int) bool {
+		return self.states[i] >= state.Timestamp
+	})
+	if pos == len(self.states) || self.states[pos] != state.Timestamp {
+		self.states = append(self.states, 0)
+		copy(self.states[pos+1:], self.states[pos:])
+		self.states[pos] = state.Timestamp
+	}
+}
+
+func (self *S3Backend) Checkpoint() {
+	self.flush()
+}
+
+func (self *S3Backend) Close() {
+	self.flush()
+}
@@ -0,0 +1,101 @@
+package enki
+
+import (
+	"sync"
+)
+
+// SharedBackend only keeps a backend open while it is in use: the
+// first Acquire opens it and the last Release closes it. Long running
+// readers (web server, mount) acquire it for each request, so that the
+// repository is not locked in between and new snapshots show up.
+// Calls are serialized and forwarded to the backend currently open.
+type SharedBackend struct {
+	open    func() (Backend, error)
+	backend Backend
+	users   int
+	mutex   sync.Mutex
+}
+
+func NewSharedBackend(open func() (Backend, error)) *SharedBackend {
+	return &SharedBackend{open: open}
+}
+
+// Open the backend if it is not already
+func (self *SharedBackend) Acquire() (err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.users == 0 {
+		defer recoverError(&err)
+		self.backend, err = self.open()
+		if err != nil {
+			return err
+		}
+	}
+	self.users += 1
+	return nil
+}
+
+// Close the backend if nobody else uses it
+func (self *SharedBackend) Release() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.users -= 1
+	if self.users == 0 {
+		backend := self.backend
+		self.backend = nil
+		backend.Close()
+	}
+}
+
+func (self *SharedBackend) current() Backend {
+	if self.backend == nil {
+		panic("Shared backend used without being acquired")
+	}
+	return self.backend
+}
+
+func (self *SharedBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.current().AddBlock(weak, strong, data)
+}
+
+func (self *SharedBackend) SearchWeak(weak WeakHash) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current().SearchWeak(weak)
+}
+
+func (self *SharedBackend) ReadStrong(strong *StrongHash) Block {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current().ReadStrong(strong)
+}
+
+func (self *SharedBackend) ReadSignature(checksum []byte) *Signature {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current().ReadSignature(checksum)
+}
+
+func (self *SharedBackend) WriteSignature(checksum []byte, sgn *Signature) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.current().WriteSignature(checksum, sgn)
+}
+
+func (self *SharedBackend) ReadState(timestamp int64) *DirState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current().ReadState(timestamp)
+}
+
+func (self *SharedBackend) WriteState(state *DirState) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.current().WriteState(state)
+}
+
+// The backend is closed by the last Release
+func (self *SharedBackend) Close() {
+}
@@ -8,8 +8,18 @@ import (
 )
 
 const (
-	DATA_SGM = iota
-	HASH_SGM = iota
+	DATA_SGM  = iota
+	HASH_SGM  = iota
+	INDEX_SGM = iota
+)
+
+// Once a signature reaches one of those limits, its segments are
+// flushed to the backend as an index chunk, and replaced by a single
+// INDEX_SGM segment in the level above. Signatures of large files thus
+// form a tree whose root stays small.
+var (
+	chunkSegments = 1024
+	chunkData     = 1 << 20
 )
 
 type Segment struct {
@@ -17,29 +27,118 @@ type Segment struct {
 	Weakhash   WeakHash
 	Stronghash *StrongHash
 	Data       []byte
+	// Size of the content of HASH_SGM and INDEX_SGM segments (zero
+	// in signatures recorded before sizes were)
+	Size int64
 }
 
 type Signature struct {
-	Segments []Segment
+	Segments    []Segment
+	backend     Backend
+	parent      *Signature
+	dataSize    int
+	contentSize int64
+}
+
+// Returns a signature that writes its segments to the backend as soon
+// as they fill a chunk. Close must be called once all segments are
+// added.
+func NewSignature(backend Backend) *Signature {
+	return &Signature{backend: backend}
 }
 
 func (self *Signature) AddData(data []byte) {
+	if self.backend != nil {
+		// Literal runs are stored as regular blocks, so they are
+		// deduplicated and the signature only holds references
+		if len(data) == 0 {
+			return
+		}
+		weak, _, _ := GetWeakHash(data)
+		strong := GetStrongHash(data)
+		self.backend.AddBlock(weak, strong, data)
+		self.AddHash(weak, strong, int64(len(data)))
+		return
+	}
+
 	strong := StrongHash(md5.Sum(data))
 	segment := Segment{
 		Mode: DATA_SGM,
 		Data: data,
 		Stronghash: &strong,
 	}
-	self.Segments = append(self.Segments, segment)
+	self.dataSize += len(data)
+	self.add(segment)
 }
 
-func (self *Signature) AddHash(weak WeakHash, strong *StrongHash) {
+func (self *Signature) AddHash(weak WeakHash, strong *StrongHash, size int64) {
 	segment := Segment{
 		Mode:       HASH_SGM,
 		Weakhash:   weak,
 		Stronghash: strong,
+		Size:       size,
 	}
+	self.add(segment)
+}
+
+func (self *Signature) addIndex(checksum []byte, size int64) {
+	strong := StrongHash{}
+	copy(strong[:], checksum)
+	segment := Segment{
+		Mode:       INDEX_SGM,
+		Stronghash: &strong,
+		Size:       size,
+	}
+	self.add(segment)
+}
+
+func (self *Signature) add(segment Segment) {
 	self.Segments = append(self.Segments, segment)
+	self.contentSize += segment.contentSize()
+	if self.backend == nil {
+		return
+	}
+	if len(self.Segments) >= chunkSegments || self.dataSize >= chunkData {
+		self.flush()
+	}
+}
+
+// Write current segments as a chunk and reference it in the parent
+func (self *Signature) flush() {
+	chunk := &Signature{Segments: self.Segments}
+	checksum := chunk.CheckSum()
+	self.backend.WriteSignature(checksum, chunk)
+	if self.parent == nil {
+		self.parent = NewSignature(self.backend)
+	}
+	self.parent.addIndex(checksum, self.contentSize)
+	self.Segments = nil
+	self.dataSize = 0
+	self.contentSize = 0
+}
+
+// Flush pending segments and move the root of the tree in the
+// signature itself.
+func (self *Signature) Close() {
+	if self.parent == nil {
+		return
+	}
+	if len(self.Segments) > 0 {
+		self.flush()
+	}
+	self.parent.Close()
+	self.Segments = self.parent.Segments
+	self.contentSize = self.parent.contentSize
+	self.parent = nil
+	self.dataSize = 0
+}
+
+// Size of the content described by the segment, zero if unknown
+func (self *Segment) contentSize() int64 {
+	if self.Mode == DATA_SGM {
+		return int64(len(self.Data))
+	}
+	return self.Size
 }
 
 func (self *Signature) CheckSum() []byte {
@@ -62,6 +161,12 @@ func (self *Signature) Extract(backend Backend, w io.Writer) {
 			}
 			_, err := w.Write(data)
 			check(err)
+		} else if segment.Mode == INDEX_SGM {
+			chunk := backend.ReadSignature(segment.Stronghash[:])
+			if chunk == nil {
+				panic("Signature chunk not found in backend")
+			}
+			chunk.Extract(backend, w)
 		}
 	}
 }
@@ -0,0 +1,189 @@
+package enki
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotFS exposes the files of a state as a read-only fs.FS (with
+// the fs.ReadDirFS and fs.StatFS extensions). Files are io.ReaderAt
+// and io.Seeker, reads only fetch the blocks they need from the
+// backend.
+type SnapshotFS struct {
+	backend Backend
+	state   *DirState
+	// Content of each directory, "." being the root
+	dirs map[string][]string
+}
+
+func NewSnapshotFS(backend Backend, state *DirState) *SnapshotFS {
+	self := &SnapshotFS{
+		backend: NewSyncBackend(backend),
+		state:   state,
+		dirs:    map[string][]string{".": nil},
+	}
+	for name := range state.FileStates {
+		name = filepath.ToSlash(name)
+		// Register the file and every missing parent directory
+		for name != "." {
+			dir := path.Dir(name)
+			_, known := self.dirs[dir]
+			self.dirs[dir] = append(self.dirs[dir], path.Base(name))
+			if known {
+				break
+			}
+			name = dir
+		}
+	}
+	for _, children := range self.dirs {
+		sort.Strings(children)
+	}
+	return self
+}
+
+func (self *SnapshotFS) Open(name string) (fs.File, error) {
+	info, err := self.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &snapshotDir{fsys: self, info: info, name: name}, nil
+	}
+	fst := self.state.FileStates[filepath.FromSlash(name)]
+	sgn := self.backend.ReadSignature(fst.SgnSum)
+	if sgn == nil {
+		err := errors.New("Signature not found in backend")
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &snapshotFile{NewSignatureReader(self.backend, sgn), info}, nil
+}
+
+func (self *SnapshotFS) Stat(name string) (fs.FileInfo, error) {
+	return self.stat("stat", name)
+}
+
+func (self *SnapshotFS) stat(op, name string) (*snapshotInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := self.dirs[name]; ok {
+		return &snapshotInfo{
+			name:    path.Base(name),
+			mode:    fs.ModeDir | 0555,
+			modTime: time.Unix(self.state.Timestamp, 0),
+		}, nil
+	}
+	fst, ok := self.state.FileStates[filepath.FromSlash(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &snapshotInfo{
+		name:    path.Base(name),
+		size:    fst.Size,
+		mode:    0444,
+		modTime: fst.ModTime(),
+	}, nil
+}
+
+func (self *SnapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := self.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	var entries []fs.DirEntry
+	for _, child := range self.dirs[name] {
+		info, err := self.stat("readdir", path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+type snapshotInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (self *snapshotInfo) Name() string       { return self.name }
+func (self *snapshotInfo) Size() int64        { return self.size }
+func (self *snapshotInfo) Mode() fs.FileMode  { return self.mode }
+func (self *snapshotInfo) ModTime() time.Time { return self.modTime }
+func (self *snapshotInfo) IsDir() bool        { return self.mode.IsDir() }
+func (self *snapshotInfo) Sys() interface{}   { return nil }
+
+type snapshotFile struct {
+	*SignatureReader
+	info *snapshotInfo
+}
+
+func (self *snapshotFile) Stat() (fs.FileInfo, error) {
+	if self.info.size == 0 {
+		// States recorded before sizes were
+		size, err := self.Size()
+		if err != nil {
+			return nil, err
+		}
+		self.info.size = size
+	}
+	return self.info, nil
+}
+
+func (self *snapshotFile) Close() error {
+	return nil
+}
+
+type snapshotDir struct {
+	fsys    *SnapshotFS
+	info    *snapshotInfo
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (self *snapshotDir) Stat() (fs.FileInfo, error) {
+	return self.info, nil
+}
+
+func (self *snapshotDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: self.name, Err: errors.New("is a directory")}
+}
+
+func (self *snapshotDir) Close() error {
+	return nil
+}
+
+func (self *snapshotDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !self.read {
+		entries, err := self.fsys.ReadDir(self.name)
+		if err != nil {
+			return nil, err
+		}
+		self.entries, self.read = entries, true
+	}
+	if n <= 0 {
+		entries := self.entries
+		self.entries = nil
+		return entries, nil
+	}
+	if len(self.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(self.entries) {
+		n = len(self.entries)
+	}
+	entries := self.entries[:n]
+	self.entries = self.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,67 @@
+package enki
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSnapshotFS(t *testing.T) {
+	root := t.TempDir()
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := map[string][]byte{
+		"a.txt":         []byte("first file"),
+		"dir/big.data":  big,
+		"dir/sub/c.txt": []byte("third file"),
+	}
+	for name, content := range files {
+		abspath := path.Join(root, name)
+		check(os.MkdirAll(path.Dir(abspath), 0750))
+		check(os.WriteFile(abspath, content, 0644))
+	}
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	fsys := NewSnapshotFS(backend, state)
+
+	check(fstest.TestFS(fsys, "a.txt", "dir/big.data", "dir/sub/c.txt"))
+	var walked []string
+	check(fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	}))
+	if len(walked) != 6 {
+		t.Errorf("Unexpected walk %v", walked)
+	}
+
+	fd, err := fsys.Open("dir/big.data")
+	check(err)
+	defer fd.Close()
+	reader := fd.(io.ReaderAt)
+	buf := make([]byte, 100000)
+	for _, off := range []int64{700000, 0, 65530, int64(len(big)) - 100000} {
+		n, err := reader.ReadAt(buf, off)
+		check(err)
+		if n != len(buf) || !bytes.Equal(buf, big[off:off+int64(n)]) {
+			t.Errorf("Unexpected content at offset %v", off)
+		}
+	}
+	n, err := reader.ReadAt(buf, int64(len(big))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("Unexpected read past the end: %v, %v", n, err)
+	}
+	seeker := fd.(io.ReadSeeker)
+	pos, err := seeker.Seek(-5, io.SeekEnd)
+	check(err)
+	tail, err := io.ReadAll(seeker)
+	check(err)
+	if pos != int64(len(big))-5 || !bytes.Equal(tail, big[len(big)-5:]) {
+		t.Errorf("Unexpected content after seek")
+	}
+}
@@ -0,0 +1,241 @@
+package enki
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+)
+
+const (
+	// Initial size of the weak hashes filter, it grows with the
+	// number of blocks
+	sqliteBloomCapacity = 1 << 20
+	sqliteBloomFPRate   = DefaultBloomFPRate
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	strong BLOB PRIMARY KEY,
+	weak INTEGER NOT NULL,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS blocks_weak ON blocks (weak);
+CREATE TABLE IF NOT EXISTS signatures (
+	checksum BLOB PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS states (
+	timestamp INTEGER PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bloom (
+	id INTEGER PRIMARY KEY CHECK (id = 0),
+	data BLOB NOT NULL
+);
+`
+
+// SQLiteBackend stores blocks (inline), signatures and states in a
+// single SQLite database. Like BoltBackend, everything is written in
+// one transaction committed on Close (or Checkpoint). The database is
+// in WAL mode, so any number of readers (see
+// NewReadOnlySQLiteBackend) can run alongside a writer.
+//
+// Weak hashes are searched for every byte of the files being
+// snapshotted: a bloom filter (saved in the database on commit) is
+// tested first and the blocks_weak index is only queried on a hit.
+type SQLiteBackend struct {
+	db         *sql.DB
+	tx         *sql.Tx
+	bloom      *BloomFilter
+	bloomDirty bool
+	readOnly   bool
+}
+
+func NewSQLiteBackend(dbPath string) Backend {
+	db, err := sql.Open("sqlite3",
+		sqliteDSN(dbPath, "_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"))
+	check(err)
+	_, err = db.Exec(sqliteSchema)
+	check(err)
+	tx, err := db.Begin()
+	check(err)
+	backend := &SQLiteBackend{db: db, tx: tx}
+	backend.loadBloom()
+	return backend
+}
+
+// Open the database without ever writing to it, every method that
+// would modify it panics.
+func NewReadOnlySQLiteBackend(dbPath string) Backend {
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath, "mode=ro&_busy_timeout=5000"))
+	check(err)
+	backend := &SQLiteBackend{db: db, readOnly: true}
+	backend.loadBloom()
+	return backend
+}
+
+// Returns a "file:" URI, with the path escaped so that characters
+// like "?" or "#" are not taken for the query or the fragment
+func sqliteDSN(dbPath string, params string) string {
+	return "file:" + (&url.URL{Path: dbPath}).EscapedPath() + "?" + params
+}
+
+// Load the weak hashes filter, it is rebuilt if it is missing (from
+// the databases written before it existed) or full
+func (self *SQLiteBackend) loadBloom() {
+	var data []byte
+	// Read-only backends do not create the missing tables
+	if self.queryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'bloom'") != nil {
+		data = self.queryRow("SELECT data FROM bloom WHERE id = 0")
+	}
+	if data != nil {
+		bloom, err := LoadBloomFilter(data)
+		check(err)
+		self.bloom = bloom
+	}
+	if self.bloom == nil || self.bloom.Count() > self.bloom.Capacity() {
+		self.rebuildBloom()
+	}
+}
+
+func (self *SQLiteBackend) rebuildBloom() {
+	capacity := uint64(sqliteBloomCapacity)
+	if self.bloom != nil && 2*self.bloom.Count() > capacity {
+		capacity = 2 * self.bloom.Count()
+	}
+	self.bloom = NewBloomFilter(capacity, sqliteBloomFPRate)
+	// Only reads the blocks_weak index
+	rows, err := self.query("SELECT weak FROM blocks")
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var weak int64
+		check(rows.Scan(&weak))
+		self.bloom.Add(WeakHash(weak))
+	}
+	check(rows.Err())
+	self.bloomDirty = true
+}
+
+// Save the filter in the pending transaction
+func (self *SQLiteBackend) saveBloom() {
+	if !self.bloomDirty {
+		return
+	}
+	if self.bloom.Count() > self.bloom.Capacity() {
+		self.rebuildBloom()
+	}
+	self.exec("INSERT OR REPLACE INTO bloom (id, data) VALUES (0, ?)", self.bloom.Bytes())
+	self.bloomDirty = false
+}
+
+// Queries go through the pending transaction, if any, so that they
+// see what was written since last commit
+func (self *SQLiteBackend) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if self.tx != nil {
+		return self.tx.Query(query, args...)
+	}
+	return self.db.Query(query, args...)
+}
+
+func (self *SQLiteBackend) queryRow(query string, args ...interface{}) []byte {
+	var row *sql.Row
+	if self.tx != nil {
+		row = self.tx.QueryRow(query, args...)
+	} else {
+		row = self.db.QueryRow(query, args...)
+	}
+	var data []byte
+	err := row.Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err)
+	return data
+}
+
+func (self *SQLiteBackend) exec(query string, args ...interface{}) {
+	if self.readOnly {
+		panic("Backend is read-only")
+	}
+	_, err := self.tx.Exec(query, args...)
+	check(err)
+}
+
+func (self *SQLiteBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	self.exec("INSERT OR IGNORE INTO blocks (strong, weak, data) VALUES (?, ?, ?)",
+		strong[:], int64(weak), []byte(data))
+	self.bloom.Add(weak)
+	self.bloomDirty = true
+}
+
+func (self *SQLiteBackend) SearchWeak(weak WeakHash) bool {
+	if !self.bloom.Test(weak) {
+		return false
+	}
+	return self.queryRow("SELECT 1 FROM blocks WHERE weak = ? LIMIT 1", int64(weak)) != nil
+}
+
+func (self *SQLiteBackend) ReadStrong(strong *StrongHash) Block {
+	data := self.queryRow("SELECT data FROM blocks WHERE strong = ?", strong[:])
+	if data == nil {
+		return nil
+	}
+	return Block(data)
+}
+
+func (self *SQLiteBackend) ReadSignature(checksum []byte) *Signature {
+	data := self.queryRow("SELECT data FROM signatures WHERE checksum = ?", checksum)
+	if data == nil {
+		return nil
+	}
+	sgn := &Signature{}
+	check(sgn.GobDecode(data))
+	return sgn
+}
+
+func (self *SQLiteBackend) WriteSignature(checksum []byte, sgn *Signature) {
+	data, err := sgn.GobEncode()
+	check(err)
+	self.exec("INSERT OR IGNORE INTO signatures (checksum, data) VALUES (?, ?)",
+		checksum, data)
+}
+
+// Returns the state with the given timestamp, or the closest earlier
+// one
+func (self *SQLiteBackend) ReadState(timestamp int64) *DirState {
+	data := self.queryRow(
+		"SELECT data FROM states WHERE timestamp <= ? ORDER BY timestamp DESC LIMIT 1",
+		timestamp)
+	if data == nil {
+		return nil
+	}
+	state := &DirState{}
+	state.GobDecode(data)
+	return state
+}
+
+func (self *SQLiteBackend) WriteState(state *DirState) {
+	self.exec("INSERT OR REPLACE INTO states (timestamp, data) VALUES (?, ?)",
+		state.Timestamp, state.GobEncode())
+}
+
+// Commit everything written so far and start a new transaction
+func (self *SQLiteBackend) Checkpoint() {
+	if self.readOnly {
+		panic("Backend is read-only")
+	}
+	self.saveBloom()
+	check(self.tx.Commit())
+	tx, err := self.db.Begin()
+	check(err)
+	self.tx = tx
+}
+
+func (self *SQLiteBackend) Close() {
+	if !self.readOnly {
+		self.saveBloom()
+		check(self.tx.Commit())
+	}
+	check(self.db.Close())
+}
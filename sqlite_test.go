@@ -0,0 +1,98 @@
+package enki
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSQLiteBackend(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "repo.db")
+	block := Block("some block")
+	weak, _, _ := GetWeakHash(block)
+	strong := GetStrongHash(block)
+
+	backend := NewSQLiteBackend(dbPath)
+	backend.AddBlock(weak, strong, block)
+	backend.AddBlock(weak, strong, block)
+	sgn := &Signature{}
+	sgn.AddHash(weak, strong, int64(len(block)))
+	backend.WriteSignature([]byte("checksum"), sgn)
+	backend.WriteState(&DirState{Timestamp: 1432808440})
+	backend.WriteState(&DirState{Timestamp: 1432808454})
+	// Pending writes are visible before commit
+	if !bytes.Equal(backend.ReadStrong(strong), block) {
+		t.Errorf("Block not found before commit")
+	}
+	backend.Close()
+
+	// Several readers can open the database alongside a writer
+	writer := NewSQLiteBackend(dbPath)
+	defer writer.Close()
+	first := NewReadOnlySQLiteBackend(dbPath)
+	defer first.Close()
+	second := NewReadOnlySQLiteBackend(dbPath)
+	defer second.Close()
+	for _, reader := range []Backend{writer, first, second} {
+		if !reader.SearchWeak(weak) {
+			t.Errorf("Weak hash not found")
+		}
+		if !bytes.Equal(reader.ReadStrong(strong), block) {
+			t.Errorf("Block not found")
+		}
+		if reader.ReadSignature([]byte("checksum")) == nil {
+			t.Errorf("Signature not found")
+		}
+		if reader.ReadState(1432808450).Timestamp != 1432808440 {
+			t.Errorf("Nearest earlier state not found")
+		}
+		if LastState(reader).Timestamp != 1432808454 {
+			t.Errorf("Last state not found")
+		}
+		if reader.ReadState(1432808439) != nil {
+			t.Errorf("Unexpected state")
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Write on read-only backend should fail")
+			}
+		}()
+		first.AddBlock(weak, strong, block)
+	}()
+}
+
+func TestSQLiteWeakSearch(t *testing.T) {
+	// Characters with a meaning in URIs must not break the path
+	dbPath := path.Join(t.TempDir(), "repo?#%.db")
+	backend := NewSQLiteBackend(dbPath)
+	var weaks []WeakHash
+	for i := 0; i < 100; i++ {
+		block := Block(fmt.Sprintf("block %v", i))
+		weak, _, _ := GetWeakHash(block)
+		backend.AddBlock(weak, GetStrongHash(block), block)
+		weaks = append(weaks, weak)
+	}
+	backend.Close()
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Fatalf("Database not created at the given path: %v", err)
+	}
+
+	// The filter is saved with the blocks, and rebuilt if missing
+	for i := 0; i < 2; i++ {
+		backend = NewSQLiteBackend(dbPath)
+		for _, weak := range weaks {
+			if !backend.SearchWeak(weak) {
+				t.Errorf("Weak hash %v not found", weak)
+			}
+		}
+		if backend.SearchWeak(1) {
+			t.Errorf("Unexpected weak hash")
+		}
+		backend.(*SQLiteBackend).exec("DELETE FROM bloom")
+		backend.Close()
+	}
+}
@@ -0,0 +1,16 @@
+package enki
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode number and the ctime (in nanoseconds) of a file
+func statExtra(info os.FileInfo) (uint64, int64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	ctime := int64(st.Ctim.Sec)*int64(1e9) + int64(st.Ctim.Nsec)
+	return uint64(st.Ino), ctime
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package enki
+
+import (
+	"os"
+)
+
+// Inode and ctime are not portable, fallback on mtime and size only
+func statExtra(info os.FileInfo) (uint64, int64) {
+	return 0, 0
+}
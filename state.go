@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -22,9 +24,17 @@ const (
 
 type FileState struct {
 	Timestamp int64
+	// md5 of the file content (older snapshots hold the md5 of the
+	// signature segments instead)
 	SgnSum   []byte
 	status    int
 	Sgn       *Signature
+	ModTimeNs int64
+	Size      int64
+	Inode     uint64
+	CtimeNs   int64
+	// Permission bits, zero in states recorded before modes were
+	Mode      os.FileMode
 }
 
 type DirState struct {
@@ -33,9 +43,37 @@ type DirState struct {
 	backend    Backend
 	prevState  *DirState
 	root       string
+	options    ScanOptions
+	queue      chan scanJob
+	mutex      sync.Mutex
+	// Set when files were hashed again and only their metadata
+	// changed
+	metaChanged bool
+}
+
+type ScanOptions struct {
+	// Re-hash every file, even if its metadata did not change
+	Checksum bool
+	// Number of files chunked concurrently
+	Jobs int
+	// Only compute file checksums: signatures are not built and
+	// nothing is written to the backend (the resulting state can
+	// not be snapshotted)
+	HashOnly bool
+}
+
+type scanJob struct {
+	relpath string
+	fst     FileState
+	present bool
+	prev    FileState
 }
 
 func NewDirState(path string, backend Backend, prevState  *DirState) *DirState {
+	return ScanDirState(path, backend, prevState, ScanOptions{})
+}
+
+func ScanDirState(path string, backend Backend, prevState *DirState, options ScanOptions) *DirState {
 	fstates := make(map[string]FileState)
 
 	// Read laststate from backend if none given
@@ -55,15 +93,46 @@ func NewDirState(path string, backend Backend, prevState  *DirState) *DirState {
 		prevState:  prevState,
 		root:       path,
 		backend:    backend,
+		options:    options,
 	}
 
-	err := filepath.Walk(path, state.append)
-	check(err)
-
+	state.scan()
 	state.detect_deletion()
 	return state
 }
 
+// Walk the directory and hand every changed file to a pool of
+// workers. The backend is wrapped to serialize concurrent accesses.
+func (self *DirState) scan() {
+	jobs := self.options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	backend := self.backend
+	if jobs > 1 {
+		backend = NewSyncBackend(backend)
+	}
+	blob := &Blob{backend}
+
+	var wg sync.WaitGroup
+	self.queue = make(chan scanJob, jobs)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range self.queue {
+				self.hashFile(blob, job)
+			}
+		}()
+	}
+
+	err := filepath.Walk(self.root, self.append)
+	close(self.queue)
+	wg.Wait()
+	self.queue = nil
+	check(err)
+}
+
 func (self *DirState) append(pathname string, info os.FileInfo, err error) error {
 	dotName := info.Name() != "." && filepath.HasPrefix(info.Name(), ".")
 	if info.IsDir() {
@@ -79,39 +148,72 @@ func (self *DirState) append(pathname string, info os.FileInfo, err error) error
 	check(err)
 
 	prevFile, present := self.prevState.FileStates[relpath]
-	ts := info.ModTime().Unix()
 	newState := FileState{}
-	newState.Timestamp = ts
+	newState.Timestamp = info.ModTime().Unix()
+	newState.ModTimeNs = info.ModTime().UnixNano()
+	newState.Size = info.Size()
+	newState.Mode = info.Mode().Perm()
+	newState.Inode, newState.CtimeNs = statExtra(info)
 
-	if !present || ts != prevFile.Timestamp{
+	if !present || self.options.Checksum || !newState.SameMeta(&prevFile) {
 		// Changed file
-		blob := &Blob{self.backend}
-		abspath := path.Join(self.root, relpath)
-		fd, err := os.Open(abspath)
-		check(err)
-		defer fd.Close()
-		info, err := fd.Stat()
-		check(err)
-		newState.Sgn = blob.Snapshot(fd, info.Size())
-
-		// Compute blob checksum
-		sgnsum := newState.Sgn.CheckSum()
-		if !present {
-			newState.status = NEW_FILE
-		} else if !bytes.Equal(sgnsum, prevFile.SgnSum) {
-			newState.status = CHANGED_FILE
-		}
-		newState.SgnSum = sgnsum
-		self.FileStates[relpath] = newState
-
+		self.queue <- scanJob{relpath, newState, present, prevFile}
 	} else {
 		// No changes
 		newState.SgnSum = prevFile.SgnSum
+		self.mutex.Lock()
 		self.FileStates[relpath] = newState
+		self.mutex.Unlock()
 	}
 	return nil
 }
 
+func (self *DirState) hashFile(blob *Blob, job scanJob) {
+	abspath := path.Join(self.root, job.relpath)
+	fd, err := os.Open(abspath)
+	check(err)
+	defer fd.Close()
+	info, err := fd.Stat()
+	check(err)
+
+	// The checksum is computed on the file content and not on the
+	// signature segments, as those depend on the blocks already
+	// known by the backend (and so on the order of the workers).
+	newState := job.fst
+	checksum := md5.New()
+	// The file may have changed since it was listed, the size is the
+	// one of the content actually hashed
+	counter := &countWriter{}
+	content := io.TeeReader(fd, io.MultiWriter(checksum, counter))
+	if self.options.HashOnly {
+		_, err = io.Copy(io.Discard, content)
+		check(err)
+	} else {
+		newState.Sgn = blob.Snapshot(content, info.Size())
+	}
+	newState.Size = counter.count
+	sgnsum := checksum.Sum(nil)
+	metaChanged := false
+	if !job.present {
+		newState.status = NEW_FILE
+	} else if !bytes.Equal(sgnsum, job.prev.SgnSum) {
+		newState.status = CHANGED_FILE
+	} else if job.prev.Mode != 0 && newState.Mode != job.prev.Mode {
+		// Mode only change
+		newState.status = CHANGED_FILE
+	} else if !newState.SameMeta(&job.prev) {
+		// Same content, the new metadata has to be recorded anyway
+		// or the file would be hashed again on every scan
+		metaChanged = true
+	}
+	newState.SgnSum = sgnsum
+
+	self.mutex.Lock()
+	self.FileStates[job.relpath] = newState
+	self.metaChanged = self.metaChanged || metaChanged
+	self.mutex.Unlock()
+}
+
 func (self *DirState) Checksum() []byte {
 	checksum := md5.New()
 
@@ -141,6 +243,9 @@ func (self *DirState) detect_deletion() {
 }
 
 func (self *DirState) Snapshot() {
+	if self.options.HashOnly {
+		panic("Can not snapshot a state scanned without signatures")
+	}
 	snapped := false
 	for relpath, fst := range self.FileStates {
 		if fst.status == DELETED_FILE {
@@ -156,14 +261,49 @@ func (self *DirState) Snapshot() {
 			snapped = true
 		}
 	}
-	if snapped {
+	if snapped || self.metaChanged {
 		self.backend.WriteState(self)
 	}
 }
 
-func (self *DirState) RestorePrev() {
-	var fd io.ReadWriteCloser
-	var err error
+// Restore the files of the previous state. Files are restored
+// concurrently by a pool of workers, each of them keeping at most one
+// file open and one block in flight. A failure on a given file is
+// logged and returned, it does not abort the whole restore.
+func (self *DirState) RestorePrev() []error {
+	var errs []error
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	jobs := self.options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	backend := self.backend
+	if jobs > 1 {
+		backend = NewSyncBackend(backend)
+	}
+	blob := &Blob{backend}
+
+	report := func(relpath string, err error) {
+		log.Print("Failed to restore ", relpath, ": ", err)
+		mutex.Lock()
+		errs = append(errs, fmt.Errorf("%v: %v", relpath, err))
+		mutex.Unlock()
+	}
+
+	queue := make(chan string, jobs)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relpath := range queue {
+				if err := self.restoreFile(blob, relpath); err != nil {
+					report(relpath, err)
+				}
+			}
+		}()
+	}
 
 	for relpath, fst := range self.FileStates {
 		// Zero status means unchanged
@@ -175,29 +315,73 @@ func (self *DirState) RestorePrev() {
 			// Remove files not in prevState
 			abspath := path.Join(self.root, relpath)
 			log.Print("Delete ", relpath)
-			err = os.Remove(abspath)
-			check(err)
+			if err := os.Remove(abspath); err != nil {
+				report(relpath, err)
+			}
 			continue
 		}
 
 		// Restore missing & modfied files
-		blob := &Blob{self.backend}
-		abspath := path.Join(self.root, relpath)
+		queue <- relpath
+	}
+	close(queue)
+	wg.Wait()
+	return errs
+}
 
-		// Make sure parent dir exists
-		if fst.status == DELETED_FILE {
-			dir := filepath.Dir(abspath)
-			err = os.MkdirAll(dir, 0777)
+func (self *DirState) restoreFile(blob *Blob, relpath string) (err error) {
+	// Backends and signatures signal failures by panicking
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
 		}
-		fd, err = os.Create(abspath)
-		check(err)
-		defer fd.Close()
+	}()
+
+	prevFile := self.prevState.FileStates[relpath]
+	abspath := path.Join(self.root, relpath)
+
+	// Make sure parent dir exists
+	err = os.MkdirAll(filepath.Dir(abspath), 0777)
+	if err != nil {
+		return err
+	}
+	// Restore in a temporary file so that a failure does not leave
+	// a truncated file behind, the dot prefix hides it from scans
+	fd, err := os.CreateTemp(filepath.Dir(abspath), "."+filepath.Base(abspath)+".")
+	if err != nil {
+		return err
+	}
+	tmpPath := fd.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	// Recorded mode, or the one of the file being replaced for states
+	// recorded before modes were
+	mode := prevFile.Mode
+	if mode == 0 {
+		mode = 0644
+		if info, statErr := os.Stat(abspath); statErr == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	err = fd.Chmod(mode)
+	if err == nil {
 		log.Print("Restore ", relpath)
-		blob.Restore(self.prevState.FileStates[relpath].SgnSum, fd)
-		atime := time.Now()
-		mtime := time.Unix(fst.Timestamp, 0)
-		os.Chtimes(abspath, atime, mtime)
+		err = blob.Restore(prevFile.SgnSum, fd)
 	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tmpPath, time.Now(), prevFile.ModTime())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, abspath)
 }
 
 func (self *DirState) GobEncode() []byte {
@@ -219,6 +403,33 @@ func (self *FileState) GetStatus() int {
 	return self.status
 }
 
+// Returns true if both states share the same mtime (with nanosecond
+// precision), size, inode and ctime. States recorded before those
+// fields existed never match, so the file is hashed again.
+func (self *FileState) SameMeta(other *FileState) bool {
+	return self.ModTimeNs == other.ModTimeNs &&
+		self.Size == other.Size &&
+		self.Inode == other.Inode &&
+		self.CtimeNs == other.CtimeNs
+}
+
+// Permission bits of the file, 0644 if they were not recorded
+func (self *FileState) FileMode() os.FileMode {
+	if self.Mode == 0 {
+		return 0644
+	}
+	return self.Mode
+}
+
+// Returns the modification time of the file, with nanosecond
+// precision when available
+func (self *FileState) ModTime() time.Time {
+	if self.ModTimeNs != 0 {
+		return time.Unix(0, self.ModTimeNs)
+	}
+	return time.Unix(self.Timestamp, 0)
+}
+
 func LastState(b Backend) *DirState {
 	return b.ReadState(MAXTIMESTAMP)
 }
@@ -3,7 +3,11 @@ package enki
 import (
 	"fmt"
 	"bytes"
+	"os"
+	"path"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestScan(t *testing.T) {
@@ -14,7 +18,7 @@ func TestScan(t *testing.T) {
 	delete(dstate.FileStates, "random.data.extracted")
 
 	res := fmt.Sprintf("%x", dstate.Checksum())
-	expected := "10b11c832b0df76a4021afa889b80a34"
+	expected := "b1c49f719c0b89e50a9a5a2fa1e3efeb"
 	if res != expected {
 		t.Errorf("Checksum mismatch", res, expected)
 	}
@@ -35,3 +39,178 @@ func TestGob(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeDetection(t *testing.T) {
+	root := t.TempDir()
+	name := path.Join(root, "file.txt")
+	check(os.WriteFile(name, []byte("first content"), 0644))
+	mtime := time.Unix(1432808440, 0)
+	check(os.Chtimes(name, mtime, mtime))
+
+	backend := NewMemoryBackend()
+	prev := NewDirState(root, backend, nil)
+	prev.Snapshot()
+
+	// Same size, same mtime: only ctime (or a re-hash) can tell
+	check(os.WriteFile(name, []byte("other content"), 0644))
+	check(os.Chtimes(name, mtime, mtime))
+
+	options := ScanOptions{Checksum: true}
+	for _, opts := range []ScanOptions{{}, options} {
+		current := ScanDirState(root, backend, prev, opts)
+		fst := current.FileStates["file.txt"]
+		if fst.GetStatus() != CHANGED_FILE {
+			t.Errorf("Change not detected (options: %v)", opts)
+		}
+	}
+
+	// Untouched file is not reported
+	current := ScanDirState(root, backend, prev, options)
+	current.Snapshot()
+	next := NewDirState(root, backend, current)
+	fst := next.FileStates["file.txt"]
+	if fst.GetStatus() != 0 {
+		t.Errorf("Unexpected status %v", fst.GetStatus())
+	}
+}
+
+func TestTouchedFile(t *testing.T) {
+	root := t.TempDir()
+	name := path.Join(root, "file.txt")
+	check(os.WriteFile(name, []byte("content"), 0644))
+	backend := NewMemoryBackend()
+	NewDirState(root, backend, nil).Snapshot()
+
+	// The new mtime of an unchanged file is recorded, so the file is
+	// not hashed again on the next scan
+	mtime := time.Unix(1432808440, 0)
+	check(os.Chtimes(name, mtime, mtime))
+	current := NewDirState(root, backend, nil)
+	fst := current.FileStates["file.txt"]
+	if fst.GetStatus() != 0 {
+		t.Errorf("Unexpected status %v", fst.GetStatus())
+	}
+	current.Timestamp += 1
+	current.Snapshot()
+	last := LastState(backend)
+	if last.FileStates["file.txt"].ModTimeNs != mtime.UnixNano() {
+		t.Errorf("New mtime not recorded")
+	}
+	next := &DirState{root: root, prevState: last, FileStates: make(map[string]FileState)}
+	next.queue = make(chan scanJob, 1)
+	check(filepath.Walk(root, next.append))
+	if len(next.queue) != 0 {
+		t.Errorf("Unchanged file hashed again")
+	}
+}
+
+func TestModeChange(t *testing.T) {
+	root := t.TempDir()
+	name := path.Join(root, "script.sh")
+	check(os.WriteFile(name, []byte("#!/bin/sh"), 0644))
+	backend := NewMemoryBackend()
+	NewDirState(root, backend, nil).Snapshot()
+
+	check(os.Chmod(name, 0750))
+	current := NewDirState(root, backend, nil)
+	fst := current.FileStates["script.sh"]
+	if fst.GetStatus() != CHANGED_FILE {
+		t.Errorf("Mode change not detected")
+	}
+	current.Timestamp += 1
+	current.Snapshot()
+	fst = LastState(backend).FileStates["script.sh"]
+	if fst.FileMode() != 0750 {
+		t.Errorf("New mode not recorded: %v", fst.FileMode())
+	}
+}
+
+func TestParallelScan(t *testing.T) {
+	sequential := ScanDirState(test_data, NewMemoryBackend(), nil, ScanOptions{Jobs: 1})
+	parallel := ScanDirState(test_data, NewMemoryBackend(), nil, ScanOptions{Jobs: 4})
+	if len(sequential.FileStates) != len(parallel.FileStates) {
+		t.Errorf("File count mismatch")
+	}
+	if !bytes.Equal(sequential.Checksum(), parallel.Checksum()) {
+		t.Errorf("Checksum mismatch %x %x", sequential.Checksum(), parallel.Checksum())
+	}
+}
+
+func TestHashedSize(t *testing.T) {
+	root := t.TempDir()
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("grown since listed"), 0644))
+	state := &DirState{root: root, FileStates: make(map[string]FileState)}
+	// Size as seen when the directory was walked
+	job := scanJob{relpath: "a.txt", fst: FileState{Size: 5}}
+	state.hashFile(NewBlob(NewMemoryBackend()), job)
+	if size := state.FileStates["a.txt"].Size; size != 18 {
+		t.Errorf("Unexpected size %v", size)
+	}
+}
+
+func TestRestorePrev(t *testing.T) {
+	root := t.TempDir()
+	backend := NewMemoryBackend()
+	names := []string{"a.txt", "b.txt", "sub/c.txt", "sub/d.txt"}
+	check(os.MkdirAll(path.Join(root, "sub"), 0750))
+	for _, name := range names {
+		check(os.WriteFile(path.Join(root, name), []byte(name), 0644))
+	}
+	options := ScanOptions{Jobs: 4}
+	prev := ScanDirState(root, backend, nil, options)
+	prev.Snapshot()
+
+	// Delete, modify and add files
+	check(os.RemoveAll(path.Join(root, "sub")))
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("changed"), 0644))
+	check(os.WriteFile(path.Join(root, "new.txt"), []byte("new"), 0644))
+
+	// Make one signature unreachable, the modified file must be
+	// left untouched
+	delete(backend.(*MemoryBackend).SignatureMap, string(prev.FileStates["b.txt"].SgnSum))
+	check(os.WriteFile(path.Join(root, "b.txt"), []byte("kept"), 0644))
+
+	current := ScanDirState(root, backend, prev, options)
+	errs := current.RestorePrev()
+	if len(errs) != 1 {
+		t.Errorf("Expected one error, got %v", errs)
+	}
+	for _, name := range []string{"a.txt", "sub/c.txt", "sub/d.txt"} {
+		content, err := os.ReadFile(path.Join(root, name))
+		if err != nil || string(content) != name {
+			t.Errorf("File %v not restored (%v)", name, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("New file not deleted")
+	}
+	content, err := os.ReadFile(path.Join(root, "b.txt"))
+	if err != nil || string(content) != "kept" {
+		t.Errorf("File overwritten by a failed restore: %q (%v)", content, err)
+	}
+	entries, err := os.ReadDir(root)
+	check(err)
+	if len(entries) != 3 {
+		t.Errorf("Unexpected files left behind: %v", entries)
+	}
+}
+
+func TestRestoreMode(t *testing.T) {
+	root := t.TempDir()
+	name := path.Join(root, "script.sh")
+	check(os.WriteFile(name, []byte("#!/bin/sh"), 0750))
+	backend := NewMemoryBackend()
+	prev := NewDirState(root, backend, nil)
+	prev.Snapshot()
+
+	check(os.WriteFile(name, []byte("changed"), 0644))
+	check(os.Chmod(name, 0600))
+	if errs := NewDirState(root, backend, prev).RestorePrev(); len(errs) != 0 {
+		t.Fatalf("Restore failed: %v", errs)
+	}
+	info, err := os.Stat(name)
+	check(err)
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Unexpected mode %v", info.Mode())
+	}
+}
@@ -0,0 +1,88 @@
+package enki
+
+import (
+	"sync"
+)
+
+// SyncBackend wraps a backend to make it safe for concurrent use.
+// Weak lookups (called for every byte when rolling) only take a
+// read lock, everything else is serialized.
+type SyncBackend struct {
+	backend Backend
+	mutex   sync.RWMutex
+}
+
+func NewSyncBackend(backend Backend) Backend {
+	return &SyncBackend{backend: backend}
+}
+
+func (self *SyncBackend) AddBlock(weak WeakHash, strong *StrongHash, data Block) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.backend.AddBlock(weak, strong, data)
+}
+
+func (self *SyncBackend) SearchWeak(weak WeakHash) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.backend.SearchWeak(weak)
+}
+
+func (self *SyncBackend) ReadStrong(strong *StrongHash) Block {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.backend.ReadStrong(strong)
+}
+
+func (self *SyncBackend) HasBlock(strong *StrongHash) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return hasBlock(self.backend, strong)
+}
+
+func (self *SyncBackend) ReadSignature(checksum []byte) *Signature {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.backend.ReadSignature(checksum)
+}
+
+func (self *SyncBackend) WriteSignature(checksum []byte, sgn *Signature) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.backend.WriteSignature(checksum, sgn)
+}
+
+func (self *SyncBackend) ReadState(timestamp int64) *DirState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.backend.ReadState(timestamp)
+}
+
+func (self *SyncBackend) WriteState(state *DirState) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.backend.WriteState(state)
+}
+
+func (self *SyncBackend) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.backend.Close()
+}
+
+func (self *SyncBackend) Checkpoint() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if cp, ok := self.backend.(Checkpointer); ok {
+		cp.Checkpoint()
+	}
+}
+
+func (self *SyncBackend) WeakFilter() []byte {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if wf, ok := self.backend.(WeakFilterer); ok {
+		return wf.WeakFilter()
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package enki
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webTimeFormat = "2006-01-02T15:04:05"
+	// Number of decoded states kept in memory
+	webCachedStates = 16
+)
+
+var webTemplate = template.Must(template.New("web").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>
+{{- if .Parent}}<a href="{{.Parent}}">Parent directory</a>{{end}}
+{{- if .Zip}} | <a href="{{.Zip}}">Download as zip</a>{{end -}}
+</p>
+<table>
+{{- range .Entries}}
+<tr><td><a href="{{.Url}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Time}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// WebServer is a read-only HTML (and JSON) interface to browse the
+// snapshots of a backend. Endpoints:
+//
+//	GET /                          list of snapshots
+//	GET /snapshots/<ts>/<path>     directory listing or file content
+//	GET /zip/<ts>/<path>           zip archive of a directory
+//
+// Listings are returned as JSON when the request has a format=json
+// parameter or accepts application/json. File downloads support
+// range requests, and only fetch the blocks covering the requested range.
+// The backend is only acquired while serving requests.
+type WebServer struct {
+	backend *SharedBackend
+	states  map[int64]*DirState
+	mutex   sync.Mutex
+}
+
+type webEntry struct {
+	Name string `json:"name"`
+	Dir  bool   `json:"dir"`
+	Size int64  `json:"size,omitempty"`
+	Time string `json:"time"`
+	Url  string `json:"url"`
+}
+
+type webPage struct {
+	Title   string     `json:"title"`
+	Parent  string     `json:"parent,omitempty"`
+	Zip     string     `json:"zip,omitempty"`
+	Entries []webEntry `json:"entries"`
+}
+
+func NewWebServer(backend *SharedBackend) *WebServer {
+	return &WebServer{
+		backend: backend,
+		states:  make(map[int64]*DirState),
+	}
+}
+
+// Keeps track of the response being started, once it is an error
+// can not be reported in the body anymore
+type webResponse struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (self *webResponse) WriteHeader(code int) {
+	self.started = true
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *webResponse) Write(data []byte) (int, error) {
+	self.started = true
+	return self.ResponseWriter.Write(data)
+}
+
+func (self *WebServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &webResponse{ResponseWriter: rw}
+	// Backends signal failures by panicking
+	defer func() {
+		if rec := recover(); rec != nil {
+			if w.started {
+				// Reset the connection rather than appending the
+				// error to a truncated (but successful) response
+				panic(http.ErrAbortHandler)
+			}
+			if e, ok := rec.(httpError); ok {
+				http.Error(w, e.message, e.code)
+			} else {
+				http.Error(w, fmt.Sprint(rec), http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		panic(httpError{http.StatusMethodNotAllowed, "Read-only server"})
+	}
+	if err := self.backend.Acquire(); err != nil {
+		panic(httpError{http.StatusServiceUnavailable, err.Error()})
+	}
+	defer self.backend.Release()
+	route := strings.Trim(r.URL.Path, "/")
+	switch {
+	case route == "":
+		self.listStates(w, r)
+	case strings.HasPrefix(route+"/", "snapshots/"):
+		state, relpath := self.parseRoute(route[len("snapshots"):])
+		self.browse(w, r, state, relpath)
+	case strings.HasPrefix(route+"/", "zip/"):
+		state, relpath := self.parseRoute(route[len("zip"):])
+		self.zip(w, state, relpath)
+	default:
+		panic(httpError{http.StatusNotFound, "Unknown endpoint"})
+	}
+}
+
+// Split "/<ts>/<path>" and returns the matching state
+func (self *WebServer) parseRoute(route string) (*DirState, string) {
+	parts := strings.SplitN(strings.Trim(route, "/"), "/", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		panic(httpError{http.StatusBadRequest, "Invalid timestamp"})
+	}
+	relpath := ""
+	if len(parts) > 1 {
+		relpath = strings.Trim(path.Clean("/"+parts[1]), "/")
+	}
+	return self.readState(ts), relpath
+}
+
+func (self *WebServer) readState(ts int64) *DirState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if state, ok := self.states[ts]; ok {
+		return state
+	}
+	state := self.backend.ReadState(ts)
+	if state == nil || state.Timestamp != ts {
+		panic(httpError{http.StatusNotFound, "Snapshot not found"})
+	}
+	if len(self.states) >= webCachedStates {
+		self.states = make(map[int64]*DirState)
+	}
+	self.states[ts] = state
+	return state
+}
+
+func (self *WebServer) listStates(w http.ResponseWriter, r *http.Request) {
+	page := webPage{Title: "Snapshots"}
+	state := LastState(self.backend)
+	for state != nil {
+		name := time.Unix(state.Timestamp, 0).Format(webTimeFormat)
+		page.Entries = append(page.Entries, webEntry{
+			Name: name,
+			Dir:  true,
+			Time: name,
+			Url:  fmt.Sprintf("/snapshots/%v/", state.Timestamp),
+		})
+		state = self.backend.ReadState(state.Timestamp - 1)
+	}
+	render(w, r, page)
+}
+
+func (self *WebServer) browse(w http.ResponseWriter, r *http.Request, state *DirState, relpath string) {
+	if fst, ok := state.FileStates[filepath.FromSlash(relpath)]; ok && relpath != "" {
+		self.download(w, r, fst, relpath)
+		return
+	}
+
+	// List the files and sub-directories of relpath
+	prefix := ""
+	if relpath != "" {
+		prefix = relpath + "/"
+	}
+	base := fmt.Sprintf("/snapshots/%v/", state.Timestamp)
+	entries := make(map[string]webEntry)
+	for name, fst := range state.FileStates {
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if pos := strings.Index(rest, "/"); pos >= 0 {
+			dir := rest[:pos]
+			entries[dir] = webEntry{
+				Name: dir,
+				Dir:  true,
+				Url:  escapePath(base+prefix+dir) + "/",
+			}
+			continue
+		}
+		entries[rest] = webEntry{
+			Name: rest,
+			Size: fst.Size,
+			Time: fst.ModTime().Format(webTimeFormat),
+			Url:  escapePath(base + prefix + rest),
+		}
+	}
+	if len(entries) == 0 && relpath != "" {
+		panic(httpError{http.StatusNotFound, "File not found"})
+	}
+
+	page := webPage{
+		Title:  time.Unix(state.Timestamp, 0).Format(webTimeFormat) + "/" + relpath,
+		Parent: escapePath(path.Dir(base+relpath)) + "/",
+		Zip:    escapePath(fmt.Sprintf("/zip/%v/%v", state.Timestamp, relpath)),
+	}
+	if relpath == "" {
+		page.Parent = "/"
+	}
+	for _, entry := range entries {
+		page.Entries = append(page.Entries, entry)
+	}
+	// Directories first
+	sort.Slice(page.Entries, func(i, j int) bool {
+		a, b := page.Entries[i], page.Entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		return a.Name < b.Name
+	})
+	render(w, r, page)
+}
+
+func (self *WebServer) download(w http.ResponseWriter, r *http.Request, fst FileState, relpath string) {
+	contentType := mime.TypeByExtension(path.Ext(relpath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	sgn := self.backend.ReadSignature(fst.SgnSum)
+	if sgn == nil {
+		panic("Signature not found in backend")
+	}
+	http.ServeContent(w, r, relpath, fst.ModTime(), NewSignatureReader(self.backend, sgn))
+}
+
+func (self *WebServer) zip(w http.ResponseWriter, state *DirState, relpath string) {
+	name := time.Unix(state.Timestamp, 0).Format(webTimeFormat)
+	options := ExportOptions{Format: ZIP_FORMAT}
+	if relpath != "" {
+		name = path.Base(relpath)
+		options.Paths = []string{relpath}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": name + ".zip"}))
+	check(ExportState(self.backend, state, w, options))
+}
+
+func render(w http.ResponseWriter, r *http.Request, page webPage) {
+	if r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		check(json.NewEncoder(w).Encode(page))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	check(webTemplate.Execute(w, page))
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
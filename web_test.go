@@ -0,0 +1,209 @@
+package enki
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWebServer(t *testing.T) {
+	root := t.TempDir()
+	big := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := map[string][]byte{
+		"a.txt":         []byte("first file"),
+		"dir/big.data":  big,
+		"dir/sub/c.txt": []byte("third file"),
+	}
+	for name, content := range files {
+		abspath := path.Join(root, name)
+		check(os.MkdirAll(path.Dir(abspath), 0750))
+		check(os.WriteFile(abspath, content, 0644))
+	}
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	server := httptest.NewServer(NewWebServer(sharedBackend(backend)))
+	defer server.Close()
+
+	get := func(route string, header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", server.URL+route, nil)
+		check(err)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		check(err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		check(err)
+		return resp, body
+	}
+
+	var page webPage
+	_, body := get("/?format=json", nil)
+	check(json.Unmarshal(body, &page))
+	if len(page.Entries) != 1 || page.Entries[0].Url != fmt.Sprintf("/snapshots/%v/", state.Timestamp) {
+		t.Fatalf("Unexpected snapshot list %v", page.Entries)
+	}
+	base := page.Entries[0].Url
+
+	_, body = get(base+"dir", http.Header{"Accept": {"application/json"}})
+	check(json.Unmarshal(body, &page))
+	if len(page.Entries) != 2 || page.Entries[0].Name != "sub" || !page.Entries[0].Dir ||
+		page.Entries[1].Name != "big.data" || page.Entries[1].Size != int64(len(big)) {
+		t.Errorf("Unexpected listing %v", page.Entries)
+	}
+	_, body = get(base, nil)
+	if !strings.Contains(string(body), `href="/snapshots/`) {
+		t.Errorf("Links missing from html listing")
+	}
+
+	resp, body := get(base+"dir/big.data", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, big) {
+		t.Errorf("Download failed")
+	}
+	ranges := map[string][]byte{
+		"bytes=1000-70000":  big[1000:70001],
+		"bytes=299990-":     big[299990:],
+		"bytes=-5":          big[len(big)-5:],
+		"bytes=0-999999999": big,
+	}
+	for spec, expected := range ranges {
+		resp, body = get(base+"dir/big.data", http.Header{"Range": {spec}})
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, expected) {
+			t.Errorf("Range %v: unexpected response %v (%v bytes)", spec, resp.Status, len(body))
+		}
+	}
+	resp, _ = get(base+"dir/big.data", http.Header{"Range": {"bytes=300000-"}})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Unexpected status %v for invalid range", resp.Status)
+	}
+	resp, _ = get(base+"missing.txt", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected status %v for missing file", resp.Status)
+	}
+
+	_, body = get(fmt.Sprintf("/zip/%v/dir", state.Timestamp), nil)
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	check(err)
+	if len(zr.File) != 2 || zr.File[0].Name != "dir/big.data" || zr.File[1].Name != "dir/sub/c.txt" {
+		t.Errorf("Unexpected zip content")
+	}
+}
+
+// Fails on every block read after the first ones
+type failingBackend struct {
+	Backend
+	reads int
+}
+
+func (self *failingBackend) ReadStrong(strong *StrongHash) Block {
+	self.reads++
+	if self.reads > 8 {
+		panic("Block not available")
+	}
+	return self.Backend.ReadStrong(strong)
+}
+
+func TestWebServerAbort(t *testing.T) {
+	root := t.TempDir()
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	check(os.WriteFile(path.Join(root, "big.data"), big, 0644))
+	backend := NewMemoryBackend()
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+
+	// Errors occurring once the body is started must not be reported
+	// as a successful (but truncated) response
+	for _, route := range []string{"/zip/%v/", "/snapshots/%v/big.data"} {
+		server := httptest.NewServer(NewWebServer(sharedBackend(&failingBackend{Backend: backend})))
+		resp, err := http.Get(server.URL + fmt.Sprintf(route, state.Timestamp))
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			t.Errorf("%v: error not detected by the client", route)
+		}
+		server.Close()
+	}
+}
+
+// Shares a backend that stays open
+func sharedBackend(backend Backend) *SharedBackend {
+	return NewSharedBackend(func() (Backend, error) { return backend, nil })
+}
+
+// Releases the repository lock along with the backend
+type lockedBackend struct {
+	Backend
+	lock *RepoLock
+}
+
+func (self *lockedBackend) Close() {
+	self.Backend.Close()
+	check(self.lock.Unlock())
+}
+
+// Shares a local repository, locked and opened when acquired
+func sharedRepo(dotDir string) *SharedBackend {
+	return NewSharedBackend(func() (Backend, error) {
+		lock, err := LockRepo(dotDir, SHARED_LOCK, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &lockedBackend{NewReadOnlyBoltBackend(dotDir), lock}, nil
+	})
+}
+
+func TestWebServerRepo(t *testing.T) {
+	root := t.TempDir()
+	dotDir := t.TempDir()
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("first"), 0644))
+	backend := NewBoltBackend(dotDir)
+	state := NewDirState(root, backend, nil)
+	state.Snapshot()
+	backend.Close()
+	server := httptest.NewServer(NewWebServer(sharedRepo(dotDir)))
+	defer server.Close()
+
+	count := func() int {
+		resp, err := http.Get(server.URL + "/?format=json")
+		check(err)
+		defer resp.Body.Close()
+		var page webPage
+		check(json.NewDecoder(resp.Body).Decode(&page))
+		return len(page.Entries)
+	}
+	if count() != 1 {
+		t.Fatalf("Snapshot not listed")
+	}
+
+	// The repository is released between requests, so snapshots can
+	// be taken while browsing
+	locks, err := ListLocks(dotDir)
+	check(err)
+	if len(locks) != 0 {
+		t.Fatalf("Lock held between requests: %v", locks)
+	}
+	check(os.WriteFile(path.Join(root, "a.txt"), []byte("second"), 0644))
+	backend = NewBoltBackend(dotDir)
+	state = NewDirState(root, backend, nil)
+	state.Timestamp += 1
+	state.Snapshot()
+	backend.Close()
+	if count() != 2 {
+		t.Errorf("New snapshot not listed")
+	}
+}